@@ -0,0 +1,444 @@
+package cmt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BuildPolicy tells what to do when the build of a package fails
+type BuildPolicy int
+
+const (
+	StopOnFailure     BuildPolicy = iota // do not start new builds (running ones complete)
+	ContinueOnFailure                    // build all the packages which do not depend on a failed one
+)
+
+// BuildStatus is the status of the build of a package
+type BuildStatus int
+
+const (
+	BuildStarted BuildStatus = iota // build in progress
+	BuildOK                         // package built
+	BuildFailed                     // build failed
+	BuildSkipped                    // not built (failed dependency, stopped or cancelled build)
+)
+
+func (st BuildStatus) String() string {
+	switch st {
+	case BuildStarted:
+		return "started"
+	case BuildOK:
+		return "ok"
+	case BuildFailed:
+		return "failed"
+	case BuildSkipped:
+		return "skipped"
+	}
+	return fmt.Sprintf("BuildStatus(%d)", int(st))
+}
+
+func (st BuildStatus) MarshalText() ([]byte, error) {
+	return []byte(st.String()), nil
+}
+
+// BuildOptions configures the build of a work area
+type BuildOptions struct {
+	Jobs     int         // maximum number of packages built concurrently (default: 1)
+	Policy   BuildPolicy // what to do when a package fails to build
+	Packages []string    // packages to build, with the ones they use (default: all)
+	LogDir   string      // directory holding the build logs (default: <work area>/build-logs)
+	Make     []string    // arguments of make (e.g. "-j4")
+
+	// Progress, if not nil, is called when the build of a package starts
+	// and when it completes (or is skipped), with the number of completed
+	// packages. Calls are serialized.
+	Progress func(r BuildResult, done, total int)
+}
+
+// BuildResult is the outcome of the build of a package
+type BuildResult struct {
+	Package  string        `json:"package"`            // package full name
+	Dir      string        `json:"dir"`                // directory of the package
+	Uses     []string      `json:"uses,omitempty"`     // work area packages the package uses
+	Status   BuildStatus   `json:"status"`             // status of the build
+	Step     string        `json:"step,omitempty"`     // failed step ("config" or "make")
+	Exit     ExitStatus    `json:"-"`                  // exit status of the failed (or last) step
+	Code     int           `json:"exit_code"`          // exit code of the failed (or last) step
+	Reason   string        `json:"reason,omitempty"`   // why the package failed or was skipped
+	Log      string        `json:"log,omitempty"`      // file holding the output of the build
+	Start    time.Time     `json:"start,omitempty"`    // when the build started
+	Duration time.Duration `json:"duration,omitempty"` // duration of the build
+}
+
+// BuildReport is the outcome of the build of a work area
+type BuildReport struct {
+	Dir      string        `json:"dir"`      // work area
+	Jobs     int           `json:"jobs"`     // maximum number of concurrent builds
+	Start    time.Time     `json:"start"`    // when the build started
+	Duration time.Duration `json:"duration"` // duration of the whole build
+	Results  []BuildResult `json:"results"`  // results, in dependency order
+}
+
+func (rep *BuildReport) select_status(st BuildStatus) []BuildResult {
+	out := make([]BuildResult, 0)
+	for _, r := range rep.Results {
+		if r.Status == st {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Succeeded returns the packages which were built
+func (rep *BuildReport) Succeeded() []BuildResult {
+	return rep.select_status(BuildOK)
+}
+
+// Failed returns the packages which failed to build
+func (rep *BuildReport) Failed() []BuildResult {
+	return rep.select_status(BuildFailed)
+}
+
+// Skipped returns the packages which were not built
+func (rep *BuildReport) Skipped() []BuildResult {
+	return rep.select_status(BuildSkipped)
+}
+
+// Write writes a human readable build report into `w`
+func (rep *BuildReport) Write(w io.Writer) error {
+	format := "%-8s %10s %5s | %s\n"
+	_, err := fmt.Fprintf(w, format, "status", "time", "exit", "pkg-name")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 80))
+	for _, r := range rep.Results {
+		code := "-"
+		if r.Status == BuildOK || r.Status == BuildFailed {
+			code = fmt.Sprintf("%d", r.Code)
+		}
+		fmt.Fprintf(w, format, r.Status, r.Duration.Round(time.Millisecond), code, r.Package)
+	}
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 80))
+	_, err = fmt.Fprintf(w, "::: built: %d, failed: %d, skipped: %d (%v)\n",
+		len(rep.Succeeded()), len(rep.Failed()), len(rep.Skipped()),
+		rep.Duration.Round(time.Millisecond),
+	)
+	if err != nil {
+		return err
+	}
+	for _, r := range rep.Failed() {
+		fmt.Fprintf(w, "**error** %s: %s (log: %s)\n", r.Package, r.Reason, r.Log)
+	}
+	return nil
+}
+
+// WriteJSON writes the build report as JSON into `w`
+func (rep *BuildReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+// Build builds the packages of the work area in dependency order, running
+// 'cmt config' and 'make' in their cmt directory as soon as the packages
+// they use are built, with at most opts.Jobs concurrent builds.
+// The output of each build is written to its own log file.
+// The returned error is only about the setup of the build: build failures
+// are reported in the report.
+func (wa *WorkArea) Build(ctx context.Context, opts BuildOptions) (*BuildReport, error) {
+	if wa.cmt == nil {
+		return nil, fmt.Errorf("cmt: work area [%s] has no CMT environment", wa.Dir)
+	}
+	if opts.Jobs <= 0 {
+		opts.Jobs = 1
+	}
+	if opts.LogDir == "" {
+		opts.LogDir = filepath.Join(wa.Dir, "build-logs")
+	}
+	err := os.MkdirAll(opts.LogDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	dirs := make(map[string]string, len(wa.Packages))
+	for _, p := range wa.Packages {
+		if pkg_basename(p.Name) == WorkAreaPackageName {
+			continue
+		}
+		dirs[p.Name] = p.Dir
+	}
+	g, err := NewDepGraph(dirs)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Packages) > 0 {
+		dirs, err = select_build_packages(g, dirs, opts.Packages)
+		if err != nil {
+			return nil, err
+		}
+	}
+	order, err := build_order(g, dirs)
+	if err != nil {
+		return nil, err
+	}
+
+	rep := &BuildReport{
+		Dir:     wa.Dir,
+		Jobs:    opts.Jobs,
+		Start:   time.Now(),
+		Results: make([]BuildResult, len(order)),
+	}
+	for i, name := range order {
+		r := &rep.Results[i]
+		r.Package = name
+		r.Dir = dirs[name]
+		r.Log = filepath.Join(opts.LogDir, strings.Replace(name, "/", "_", -1)+".log")
+		for _, dep := range g.Uses[name] {
+			if _, ok := dirs[dep]; ok {
+				r.Uses = append(r.Uses, dep)
+			}
+		}
+	}
+
+	schedule(ctx, rep, opts, func(ctx context.Context, r *BuildResult) {
+		wa.build_package(ctx, r, opts)
+	})
+	rep.Duration = time.Since(rep.Start)
+	return rep, nil
+}
+
+// schedule runs `build` for the packages of the report, in the order of
+// its results, as soon as the packages they use are built, with at most
+// opts.Jobs concurrent builds.
+// Packages using a failed one, and the ones left once the build stopped
+// (opts.Policy) or was cancelled, are skipped.
+func schedule(ctx context.Context, rep *BuildReport, opts BuildOptions, build func(ctx context.Context, r *BuildResult)) {
+	order := make([]string, len(rep.Results))
+	index := make(map[string]int, len(rep.Results))
+	for i, r := range rep.Results {
+		order[i] = r.Package
+		index[r.Package] = i
+	}
+
+	done := 0
+	notify := func(r *BuildResult) {
+		if r.Status != BuildStarted {
+			done++
+		}
+		if opts.Progress != nil {
+			opts.Progress(*r, done, len(order))
+		}
+	}
+
+	// schedule the builds: a package is ready once all the packages it
+	// uses are built. The scheduler is the only writer of the results.
+	type completion struct {
+		idx int
+		res BuildResult
+	}
+	ch := make(chan completion)
+	finished := make(map[string]bool, len(order))
+	pending := make(map[string]bool, len(order))
+	for _, name := range order {
+		pending[name] = true
+	}
+	running := 0
+	stopped := false
+
+	skip := func(name, reason string) {
+		r := &rep.Results[index[name]]
+		r.Status = BuildSkipped
+		r.Reason = reason
+		delete(pending, name)
+		finished[name] = true
+		notify(r)
+	}
+
+	for len(pending) > 0 || running > 0 {
+		if ctx.Err() != nil {
+			stopped = true
+		}
+		// start all the ready packages, in dependency order
+		for _, name := range order {
+			if !pending[name] || running >= opts.Jobs || stopped {
+				continue
+			}
+			r := &rep.Results[index[name]]
+			ready := true
+			failed := ""
+			for _, dep := range r.Uses {
+				switch {
+				case !finished[dep]:
+					ready = false
+				case rep.Results[index[dep]].Status != BuildOK && failed == "":
+					failed = dep
+				}
+			}
+			if failed != "" {
+				skip(name, fmt.Sprintf("dependency [%s] was not built", failed))
+				continue
+			}
+			if !ready {
+				continue
+			}
+			delete(pending, name)
+			running++
+			r.Status = BuildStarted
+			r.Start = time.Now()
+			notify(r)
+			go func(idx int, res BuildResult) {
+				build(ctx, &res)
+				ch <- completion{idx, res}
+			}(index[name], *r)
+		}
+
+		if running == 0 {
+			// nothing can be started anymore
+			reason := "build stopped"
+			if ctx.Err() != nil {
+				reason = "build cancelled"
+			}
+			for _, name := range order {
+				if pending[name] {
+					skip(name, reason)
+				}
+			}
+			break
+		}
+
+		c := <-ch
+		running--
+		rep.Results[c.idx] = c.res
+		finished[c.res.Package] = true
+		notify(&rep.Results[c.idx])
+		if c.res.Status == BuildFailed && opts.Policy == StopOnFailure {
+			stopped = true
+		}
+	}
+}
+
+// build_package runs 'cmt config' and 'make' for the package of `r`
+func (wa *WorkArea) build_package(ctx context.Context, r *BuildResult, opts BuildOptions) {
+	defer func() { r.Duration = time.Since(r.Start) }()
+
+	f, err := os.Create(r.Log)
+	if err != nil {
+		r.Status = BuildFailed
+		r.Reason = err.Error()
+		return
+	}
+	defer f.Close()
+
+	cmtbin := wa.cmt.bin
+	if cmtbin == "" {
+		cmtbin = "cmt"
+	}
+	steps := []struct {
+		name string
+		args []string
+	}{
+		{"config", []string{cmtbin, "config"}},
+		{"make", append([]string{"make"}, opts.Make...)},
+	}
+	for _, step := range steps {
+		fmt.Fprintf(f, "::: [%s] %s\n", r.Package, strings.Join(step.args, " "))
+		cmd := wa.cmt.env.Command(ctx, step.args[0], step.args[1:]...)
+		cmd.Dir = filepath.Join(r.Dir, "cmt")
+		cmd.Stdout = f
+		cmd.Stderr = f
+		start := time.Now()
+		err = cmd.Run()
+		r.Exit = ExitStatusOf(cmd)
+		r.Exit.Duration = time.Since(start)
+		r.Code = r.Exit.Code
+		if err != nil {
+			r.Status = BuildFailed
+			r.Step = step.name
+			r.Reason = fmt.Sprintf("%s failed: %v", step.name, err)
+			if ctx.Err() != nil {
+				r.Reason = fmt.Sprintf("%s cancelled: %v", step.name, ctx.Err())
+			}
+			fmt.Fprintf(f, "::: [%s] %s\n", r.Package, r.Reason)
+			return
+		}
+	}
+	r.Status = BuildOK
+}
+
+// select_build_packages returns the packages of `dirs` which are among
+// `names` (full names or basenames) or used by one of them
+func select_build_packages(g *DepGraph, dirs map[string]string, names []string) (map[string]string, error) {
+	pkgs := make(map[string]Package, len(dirs))
+	for name := range dirs {
+		pkgs[name] = Package{Name: name}
+	}
+	roots, err := resolve_packages(pkgs, names)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string)
+	for _, name := range append(roots, g.AllUses(roots, 0)...) {
+		if dir, ok := dirs[name]; ok {
+			out[name] = dir
+		}
+	}
+	return out, nil
+}
+
+// build_order returns the packages of `dirs` sorted so that each package
+// comes after the packages it uses (ties are sorted by name).
+// It fails if the dependencies have a cycle.
+func build_order(g *DepGraph, dirs map[string]string) ([]string, error) {
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(names))
+	order := make([]string, 0, len(names))
+	var visit func(name string, stack []string) error
+	visit = func(name string, stack []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("cmt: dependency cycle: %s -> %s", strings.Join(stack, " -> "), name)
+		}
+		state[name] = visiting
+		for _, dep := range g.Uses[name] {
+			if _, ok := dirs[dep]; !ok {
+				continue
+			}
+			err := visit(dep, append(stack, name))
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		err := visit(name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// EOF
@@ -0,0 +1,212 @@
+package cmt
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		uses map[string][]string
+		pkgs []string
+		want []string // "": error
+	}{
+		{
+			name: "independent",
+			pkgs: []string{"C", "A", "B"},
+			want: []string{"A", "B", "C"},
+		},
+		{
+			name: "chain",
+			uses: map[string][]string{"A": {"B"}, "B": {"C"}},
+			pkgs: []string{"A", "B", "C"},
+			want: []string{"C", "B", "A"},
+		},
+		{
+			name: "diamond",
+			uses: map[string][]string{"A": {"B", "C"}, "B": {"D"}, "C": {"D"}},
+			pkgs: []string{"A", "B", "C", "D"},
+			want: []string{"D", "B", "C", "A"},
+		},
+		{
+			name: "outside",
+			uses: map[string][]string{"A": {"External/X"}, "B": {"A"}},
+			pkgs: []string{"A", "B"},
+			want: []string{"A", "B"},
+		},
+		{
+			name: "cycle",
+			uses: map[string][]string{"A": {"B"}, "B": {"C"}, "C": {"A"}},
+			pkgs: []string{"A", "B", "C"},
+		},
+		{
+			name: "self-cycle-outside-selection",
+			uses: map[string][]string{"A": {"B"}, "B": {"A"}},
+			pkgs: []string{"A"},
+			want: []string{"A"},
+		},
+	} {
+		g := &DepGraph{Uses: tc.uses}
+		dirs := make(map[string]string)
+		for _, name := range tc.pkgs {
+			dirs[name] = "/work/" + name
+		}
+		order, err := build_order(g, dirs)
+		if tc.want == nil {
+			if err == nil || !strings.Contains(err.Error(), "cycle") {
+				t.Errorf("%s: got %v (err=%v), want a cycle error", tc.name, order, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(order, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, order, tc.want)
+		}
+	}
+}
+
+// newTestReport returns a build report of the packages `order`, using
+// the packages `uses`
+func newTestReport(order []string, uses map[string][]string) *BuildReport {
+	rep := &BuildReport{Results: make([]BuildResult, len(order))}
+	for i, name := range order {
+		rep.Results[i] = BuildResult{Package: name, Uses: uses[name]}
+	}
+	return rep
+}
+
+// statuses returns the status of each package of the report
+func statuses(rep *BuildReport) map[string]BuildStatus {
+	out := make(map[string]BuildStatus)
+	for _, r := range rep.Results {
+		out[r.Package] = r.Status
+	}
+	return out
+}
+
+func TestBuildSchedule(t *testing.T) {
+	// D <- B <- A, D <- C, E
+	uses := map[string][]string{"A": {"B"}, "B": {"D"}, "C": {"D"}}
+	order := []string{"D", "B", "C", "A", "E"}
+
+	for _, tc := range []struct {
+		name   string
+		jobs   int
+		policy BuildPolicy
+		fail   string
+		want   map[string]BuildStatus
+	}{
+		{
+			name: "serial",
+			jobs: 1,
+			want: map[string]BuildStatus{"A": BuildOK, "B": BuildOK, "C": BuildOK, "D": BuildOK, "E": BuildOK},
+		},
+		{
+			name: "parallel",
+			jobs: 3,
+			want: map[string]BuildStatus{"A": BuildOK, "B": BuildOK, "C": BuildOK, "D": BuildOK, "E": BuildOK},
+		},
+		{
+			name:   "continue",
+			jobs:   2,
+			policy: ContinueOnFailure,
+			fail:   "B",
+			want:   map[string]BuildStatus{"A": BuildSkipped, "B": BuildFailed, "C": BuildOK, "D": BuildOK, "E": BuildOK},
+		},
+		{
+			name:   "continue-root",
+			jobs:   2,
+			policy: ContinueOnFailure,
+			fail:   "D",
+			want:   map[string]BuildStatus{"A": BuildSkipped, "B": BuildSkipped, "C": BuildSkipped, "D": BuildFailed, "E": BuildOK},
+		},
+		{
+			name:   "stop",
+			jobs:   1,
+			policy: StopOnFailure,
+			fail:   "D",
+			want:   map[string]BuildStatus{"A": BuildSkipped, "B": BuildSkipped, "C": BuildSkipped, "D": BuildFailed, "E": BuildSkipped},
+		},
+	} {
+		var mu sync.Mutex
+		built := make(map[string]bool)
+		running, maxrunning := 0, 0
+		rep := newTestReport(order, uses)
+		schedule(context.Background(), rep, BuildOptions{Jobs: tc.jobs, Policy: tc.policy},
+			func(ctx context.Context, r *BuildResult) {
+				mu.Lock()
+				for _, dep := range r.Uses {
+					if !built[dep] {
+						t.Errorf("%s: %s built before %s", tc.name, r.Package, dep)
+					}
+				}
+				running++
+				if running > maxrunning {
+					maxrunning = running
+				}
+				mu.Unlock()
+
+				time.Sleep(10 * time.Millisecond)
+
+				mu.Lock()
+				defer mu.Unlock()
+				running--
+				if r.Package == tc.fail {
+					r.Status = BuildFailed
+					return
+				}
+				r.Status = BuildOK
+				built[r.Package] = true
+			},
+		)
+		if got := statuses(rep); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+		if maxrunning > tc.jobs {
+			t.Errorf("%s: %d concurrent builds, want at most %d", tc.name, maxrunning, tc.jobs)
+		}
+		if tc.jobs > 1 && tc.fail == "" && maxrunning < 2 {
+			t.Errorf("%s: no concurrent builds", tc.name)
+		}
+	}
+}
+
+func TestBuildScheduleCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rep := newTestReport([]string{"A", "B", "C"}, map[string][]string{"B": {"A"}})
+
+	progress := make([]string, 0)
+	schedule(ctx, rep, BuildOptions{
+		Jobs: 1,
+		Progress: func(r BuildResult, done, total int) {
+			progress = append(progress, r.Package+" "+r.Status.String())
+		},
+	}, func(ctx context.Context, r *BuildResult) {
+		cancel()
+		r.Status = BuildOK
+	})
+
+	want := map[string]BuildStatus{"A": BuildOK, "B": BuildSkipped, "C": BuildSkipped}
+	if got := statuses(rep); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for _, r := range rep.Results[1:] {
+		if r.Reason != "build cancelled" {
+			t.Errorf("%s: got reason %q, want \"build cancelled\"", r.Package, r.Reason)
+		}
+	}
+	if len(progress) != 4 {
+		t.Errorf("got progress %v, want 4 events", progress)
+	}
+}
+
+// EOF
@@ -0,0 +1,312 @@
+package cmt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvCache is a local cache of the environments produced by asetup,
+// keyed by asetup tags, project and platform.
+//
+// Environments of stable releases are cached indefinitely.
+// Environments of nightlies (rel_N, latest) expire when the release area of
+// the nightly moves (e.g. latest points to a new rel_N), when it is rebuilt
+// (its stamp file, or directory, is modified) or after TTL.
+type EnvCache struct {
+	Dir string        // directory holding the cached environments
+	TTL time.Duration // maximum age of a cached nightly environment (0: no limit)
+}
+
+// DefaultEnvCache is the cache used by NewSetup.
+// It is configured from the $GO_CMT_CACHE (directory) and $GO_CMT_CACHE_TTL
+// (duration, e.g. "12h") environment variables.
+// Caching is disabled when DefaultEnvCache is nil.
+var DefaultEnvCache = default_env_cache()
+
+func default_env_cache() *EnvCache {
+	dir := os.Getenv("GO_CMT_CACHE")
+	if dir == "" {
+		return nil
+	}
+	ttl := 24 * time.Hour
+	if v := os.Getenv("GO_CMT_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			ttl = d
+		}
+	}
+	return &EnvCache{Dir: dir, TTL: ttl}
+}
+
+// NewEnvCache returns an environment cache stored under `dir`,
+// creating it if needed.
+func NewEnvCache(dir string, ttl time.Duration) (*EnvCache, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &EnvCache{Dir: dir, TTL: ttl}, nil
+}
+
+// envEntry is a cached environment
+type envEntry struct {
+	Tags     string          `json:"tags"`
+	Project  string          `json:"project"`
+	Platform string          `json:"platform"`
+	Created  time.Time       `json:"created"`
+	Nightly  bool            `json:"nightly"`
+	Stamp    string          `json:"stamp,omitempty"`     // release area of the nightly, as set by asetup (e.g. .../latest)
+	Target   string          `json:"target,omitempty"`    // release area the stamp resolved to (e.g. .../rel_3)
+	StampMod time.Time       `json:"stamp_mod,omitempty"` // modification time of the stamp file of the release area
+	Env      json.RawMessage `json:"env"`                 // environment, as encoded by Setup.Save
+}
+
+// fresh returns whether the cached environment can still be used
+func (e *envEntry) fresh(ttl time.Duration) bool {
+	if !e.Nightly {
+		return true
+	}
+	if ttl > 0 && time.Since(e.Created) > ttl {
+		return false
+	}
+	if e.Stamp == "" {
+		return false
+	}
+	target, mod, err := nightly_stamp(e.Stamp)
+	if err != nil {
+		return false
+	}
+	return target == e.Target && mod.Equal(e.StampMod)
+}
+
+// nightly_stamp_files are the files of a nightly release area whose
+// modification time tells when the nightly was (re)built
+var nightly_stamp_files = []string{
+	filepath.Join("cmt", "nightly.stamp"),
+	"nightly.stamp",
+	".stamp",
+}
+
+// nightly_stamp returns the directory the nightly release area `area`
+// resolves to (following the latest, rel_N links) and the modification
+// time of its stamp file, or of the directory itself if it has none
+func nightly_stamp(area string) (string, time.Time, error) {
+	target, err := filepath.EvalSymlinks(area)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	for _, fname := range nightly_stamp_files {
+		fi, err := os.Stat(filepath.Join(target, fname))
+		if err == nil && fi.Mode().IsRegular() {
+			return target, fi.ModTime(), nil
+		}
+	}
+	fi, err := os.Stat(target)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return target, fi.ModTime(), nil
+}
+
+// Load returns a new Setup from the environment cached for `tags` and
+// `project`, or nil if there is no such fresh environment.
+func (c *EnvCache) Load(project, tags string, verbose bool) (*Setup, error) {
+	e, err := c.entry(project, tags)
+	if err != nil || e == nil {
+		return nil, err
+	}
+	if !e.fresh(c.TTL) {
+		if verbose {
+			fmt.Printf("cmt: cached environment for [%s] expired\n", tags)
+		}
+		return nil, nil
+	}
+	if verbose {
+		fmt.Printf("cmt: loading cached environment for [%s]...\n", tags)
+	}
+	return newSetupFromReader(bytes.NewReader(e.Env), "", verbose)
+}
+
+// Store saves the environment of `s`, configured with `tags` for `project`,
+// into the cache.
+func (c *EnvCache) Store(project, tags string, s *Setup) error {
+	err := os.MkdirAll(c.Dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	err = s.Save(buf)
+	if err != nil {
+		return err
+	}
+
+	e := envEntry{
+		Tags:     tags,
+		Project:  project,
+		Platform: cache_platform(),
+		Created:  time.Now(),
+		Nightly:  is_nightly(tags),
+		Env:      json.RawMessage(buf.Bytes()),
+	}
+	if e.Nightly {
+		area := s.Getenv("AtlasArea")
+		target, mod, err := nightly_stamp(area)
+		if err == nil {
+			e.Stamp = area
+			e.Target = target
+			e.StampMod = mod
+		}
+	}
+
+	data, err := json.MarshalIndent(&e, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it, so concurrent readers
+	// only ever see complete entries.
+	f, err := ioutil.TempFile(c.Dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = f.Write(data)
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.fname(project, tags))
+}
+
+// Remove removes the environment cached for `tags` and `project`
+func (c *EnvCache) Remove(project, tags string) error {
+	err := os.Remove(c.fname(project, tags))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Purge removes all the expired environments from the cache
+func (c *EnvCache) Purge() error {
+	fnames, err := filepath.Glob(filepath.Join(c.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	errs := make([]error, 0)
+	for _, fname := range fnames {
+		e, err := read_env_entry(fname)
+		if err == nil && e.fresh(c.TTL) {
+			continue
+		}
+		errs = append(errs, os.Remove(fname))
+	}
+	return combineErrors(errs...)
+}
+
+// entry returns the cached environment for `tags` and `project` (or nil)
+func (c *EnvCache) entry(project, tags string) (*envEntry, error) {
+	e, err := read_env_entry(c.fname(project, tags))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if e.Tags != tags || e.Project != project || e.Platform != cache_platform() {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// fname returns the name of the file holding the cached environment
+func (c *EnvCache) fname(project, tags string) string {
+	h := sha1.New()
+	for _, v := range []string{tags, project, cache_platform()} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return filepath.Join(c.Dir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+func read_env_entry(fname string) (*envEntry, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var e envEntry
+	err = json.Unmarshal(data, &e)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// cache_platform returns the platform environments are cached for
+func cache_platform() string {
+	if v := os.Getenv("CMTCONFIG"); v != "" {
+		return v
+	}
+	return runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// is_nightly returns whether the asetup tags select a nightly
+func is_nightly(tags string) bool {
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "latest" {
+			return true
+		}
+		if strings.HasPrefix(tag, "rel_") {
+			_, err := strconv.Atoi(tag[len("rel_"):])
+			if err == nil || tag == "rel_latest" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newCachedSetup returns a Setup for `tags`, going through `cache` if not nil
+func newCachedSetup(cache *EnvCache, project, asetup_root, tags string, verbose bool) (*Setup, error) {
+	if cache == nil {
+		return newSetup(project, asetup_root, tags, verbose)
+	}
+
+	s, err := cache.Load(project, tags, verbose)
+	if err != nil && verbose {
+		fmt.Printf("cmt: could not load cached environment for [%s]: %v\n", tags, err)
+	}
+	if err == nil && s != nil {
+		return s, nil
+	}
+
+	s, err = newSetup(project, asetup_root, tags, verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cache.Store(project, tags, s)
+	if err != nil && verbose {
+		fmt.Printf("cmt: could not cache environment for [%s]: %v\n", tags, err)
+	}
+	return s, nil
+}
+
+// EOF
@@ -0,0 +1,317 @@
+package cmt
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ChangeLogEntry is an entry of the ChangeLog file of a package
+type ChangeLogEntry struct {
+	Date   string // date of the entry (YYYY-MM-DD)
+	Author string // author of the entry
+	Text   string // body of the entry
+}
+
+// Mentions returns whether the entry mentions the tag `tag`
+func (e *ChangeLogEntry) Mentions(tag string) bool {
+	return mentions_tag(e.Text, tag)
+}
+
+// re_changelog_header matches the first line of a ChangeLog entry
+var re_changelog_header = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})\s+(.*)$`)
+
+// ParseChangeLog parses a ChangeLog file in the usual GNU format:
+//
+//	2012-06-12  John Doe  <john.doe@cern.ch>
+//
+//		* Tagging AthenaKernel-01-02-05.
+//		* src/Foo.cxx: fix blah.
+//
+// Entries are returned in file order (most recent first).
+func ParseChangeLog(r io.Reader) ([]ChangeLogEntry, error) {
+	entries := make([]ChangeLogEntry, 0)
+	var cur *ChangeLogEntry
+	var body []string
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		cur.Text = strings.TrimSpace(strings.Join(body, "\n"))
+		entries = append(entries, *cur)
+	}
+
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scan.Scan() {
+		line := strings.TrimRight(scan.Text(), " \t\r")
+		m := re_changelog_header.FindStringSubmatch(line)
+		if m != nil {
+			flush()
+			cur = &ChangeLogEntry{Date: m[1], Author: strings.TrimSpace(m[2])}
+			body = body[:0]
+			continue
+		}
+		if cur == nil {
+			continue
+		}
+		body = append(body, strings.TrimPrefix(line, "\t"))
+	}
+	flush()
+	return entries, scan.Err()
+}
+
+// mentions_tag returns whether `text` mentions `tag`, not as a part of
+// another tag (e.g. Foo-01-02-03 is neither mentioned by Foo-01-02-03-01
+// nor by XFoo-01-02-03)
+func mentions_tag(text, tag string) bool {
+	for i := 0; i < len(text); {
+		j := strings.Index(text[i:], tag)
+		if j < 0 {
+			return false
+		}
+		beg := i + j
+		end := beg + len(tag)
+		prefixed := beg > 0 && is_word_byte(text[beg-1])
+		suffixed := end < len(text) && (is_digit(text[end]) ||
+			text[end] == '-' && end+1 < len(text) && is_digit(text[end+1]))
+		if !prefixed && !suffixed {
+			return true
+		}
+		i = beg + 1
+	}
+	return false
+}
+
+func is_digit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// is_word_byte returns whether `c` may be part of a package name
+func is_word_byte(c byte) bool {
+	return is_digit(c) || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// changelog_between returns the entries between the new tag (included)
+// and the old tag (excluded), and whether an entry for the new tag was found.
+// An empty old tag selects the entry of the new tag only.
+func changelog_between(entries []ChangeLogEntry, oldtag, newtag string) ([]ChangeLogEntry, bool) {
+	beg := -1
+	for i := range entries {
+		if entries[i].Mentions(newtag) {
+			beg = i
+			break
+		}
+	}
+	found := beg >= 0
+	if !found {
+		beg = 0
+	}
+	if oldtag == "" {
+		if !found {
+			return nil, false
+		}
+		return entries[beg : beg+1], true
+	}
+
+	end := len(entries)
+	for i := beg; i < len(entries); i++ {
+		if entries[i].Mentions(oldtag) && !entries[i].Mentions(newtag) {
+			end = i
+			break
+		}
+	}
+	return entries[beg:end], found
+}
+
+// PackageNotes are the release notes of a package
+type PackageNotes struct {
+	Entry         TagDiffEntry     // tag difference of the package
+	Dir           string           // directory of the package in the new release
+	ChangeLog     []ChangeLogEntry // ChangeLog entries between the old and new tags
+	NoChangeLog   bool             // whether the package has no ChangeLog file
+	MissingNewTag bool             // whether the ChangeLog has no entry for the new tag
+}
+
+// ProjectNotes are the release notes of the packages of a project
+type ProjectNotes struct {
+	Name     string
+	Packages []PackageNotes
+}
+
+// ReleaseNotes are the release notes assembled from a tag diff, grouped
+// by project and package
+type ReleaseNotes struct {
+	Old      string
+	New      string
+	Projects []ProjectNotes
+}
+
+// NewReleaseNotes assembles release notes for the packages changed or added
+// in `r`, by reading the ChangeLog of each package in the new release.
+func NewReleaseNotes(r *TagDiffResult) (*ReleaseNotes, error) {
+	notes := &ReleaseNotes{Old: r.Old, New: r.New}
+	projs := make(map[string]*ProjectNotes)
+	names := make([]string, 0)
+	for _, e := range r.Changes() {
+		if e.Kind == Removed {
+			continue
+		}
+		pn := PackageNotes{Entry: e, Dir: find_package_dir(r.NewProjects, e.New)}
+		err := pn.read_changelog()
+		if err != nil {
+			return nil, err
+		}
+
+		proj := e.Project()
+		if projs[proj] == nil {
+			projs[proj] = &ProjectNotes{Name: proj}
+			names = append(names, proj)
+		}
+		projs[proj].Packages = append(projs[proj].Packages, pn)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		notes.Projects = append(notes.Projects, *projs[name])
+	}
+	return notes, nil
+}
+
+// read_changelog fills the ChangeLog entries of the package
+func (pn *PackageNotes) read_changelog() error {
+	if pn.Dir == "" {
+		pn.NoChangeLog = true
+		pn.MissingNewTag = true
+		return nil
+	}
+	f, err := os.Open(filepath.Join(pn.Dir, "ChangeLog"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			pn.NoChangeLog = true
+			pn.MissingNewTag = true
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	entries, err := ParseChangeLog(f)
+	if err != nil {
+		return fmt.Errorf("cmt: could not parse ChangeLog of [%s]: %v", pn.Entry.Name, err)
+	}
+	found := false
+	pn.ChangeLog, found = changelog_between(entries, pn.Entry.Old.Version, pn.Entry.New.Version)
+	pn.MissingNewTag = !found
+	return nil
+}
+
+// Missing returns the packages whose ChangeLog has no entry for the new tag
+func (n *ReleaseNotes) Missing() []PackageNotes {
+	out := make([]PackageNotes, 0)
+	for _, proj := range n.Projects {
+		for _, pn := range proj.Packages {
+			if pn.MissingNewTag {
+				out = append(out, pn)
+			}
+		}
+	}
+	return out
+}
+
+// WriteMarkdown writes the release notes as GitHub-flavoured Markdown into `w`
+func (n *ReleaseNotes) WriteMarkdown(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# Release notes: `%s` → `%s`\n", n.Old, n.New)
+	if err != nil {
+		return err
+	}
+	for _, proj := range n.Projects {
+		fmt.Fprintf(w, "\n## %s\n", or_dash(proj.Name))
+		for _, pn := range proj.Packages {
+			e := pn.Entry
+			fmt.Fprintf(w, "\n### %s (%s → %s)\n\n",
+				e.Name, or_dash(short_version(e.Old)), or_dash(short_version(e.New)),
+			)
+			switch {
+			case pn.NoChangeLog:
+				fmt.Fprintf(w, "> **warning:** no ChangeLog\n")
+			case pn.MissingNewTag:
+				fmt.Fprintf(w, "> **warning:** no ChangeLog entry for %s\n", e.New.Version)
+			}
+			for _, cl := range pn.ChangeLog {
+				fence := md_fence(cl.Text)
+				fmt.Fprintf(w, "\n**%s** %s\n\n%s\n%s\n%s\n", cl.Date, cl.Author, fence, cl.Text, fence)
+			}
+		}
+	}
+
+	missing := n.Missing()
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "\n## Packages without a ChangeLog entry for their new tag\n\n")
+		for _, pn := range missing {
+			fmt.Fprintf(w, "- `%s` (%s)\n", pn.Entry.Name, pn.Entry.New.Version)
+		}
+	}
+	return nil
+}
+
+// md_fence returns a Markdown code fence longer than any run of backticks
+// in `text`
+func md_fence(text string) string {
+	n, run := 0, 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != '`' {
+			run = 0
+			continue
+		}
+		run++
+		if run > n {
+			n = run
+		}
+	}
+	if n < 3 {
+		n = 2
+	}
+	return strings.Repeat("`", n+1)
+}
+
+// WriteHTML writes the release notes as a self-contained HTML page into `w`
+func (n *ReleaseNotes) WriteHTML(w io.Writer) error {
+	return html_notes.Execute(w, n)
+}
+
+var html_notes = template.Must(template.New("notes").Funcs(template.FuncMap{
+	"short": func(p Package) string { return or_dash(short_version(p)) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Release notes: {{.Old}} → {{.New}}</title>
+<style>` + html_style + `
+pre { background: #f6f8fa; padding: 0.5em; }
+.warning { color: #b31d28; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Release notes: <code>{{.Old}}</code> → <code>{{.New}}</code></h1>
+{{range .Projects}}<h2>{{.Name}}</h2>
+{{range .Packages}}<h3>{{.Entry.Name}} ({{short .Entry.Old}} → {{short .Entry.New}})</h3>
+{{if .NoChangeLog}}<p class="warning">no ChangeLog</p>
+{{else if .MissingNewTag}}<p class="warning">no ChangeLog entry for {{.Entry.New.Version}}</p>
+{{end}}{{range .ChangeLog}}<p><b>{{.Date}}</b> {{.Author}}</p>
+<pre>{{.Text}}</pre>
+{{end}}{{end}}{{end}}{{with .Missing}}<h2>Packages without a ChangeLog entry for their new tag</h2>
+<ul>
+{{range .}}<li><code>{{.Entry.Name}}</code> ({{.Entry.New.Version}})</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// EOF
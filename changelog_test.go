@@ -0,0 +1,149 @@
+package cmt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testChangeLog = `Some preamble, ignored.
+
+2012-06-14  Jane Roe  <jane.roe@cern.ch>
+
+	* Tagging AthenaKernel-01-02-06.
+	* src/Bar.cxx: use ` + "```" + `std::move` + "```" + `.
+
+2012-06-12  John Doe  <john.doe@cern.ch>
+
+	* Tagging AthenaKernel-01-02-05.
+	* src/Foo.cxx: fix blah.
+
+	* AthenaKernel/Foo.h: blah.
+
+2012-05-02 John Doe
+	* Tagging AthenaKernel-01-02-04
+2012-04-30  John Doe
+	* XAthenaKernel-01-02-03 and AthenaKernel-01-02-03-01: unrelated.
+`
+
+func TestParseChangeLog(t *testing.T) {
+	entries, err := ParseChangeLog(strings.NewReader(testChangeLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ChangeLogEntry{
+		{"2012-06-14", "Jane Roe  <jane.roe@cern.ch>", "* Tagging AthenaKernel-01-02-06.\n* src/Bar.cxx: use ```std::move```."},
+		{"2012-06-12", "John Doe  <john.doe@cern.ch>", "* Tagging AthenaKernel-01-02-05.\n* src/Foo.cxx: fix blah.\n\n* AthenaKernel/Foo.h: blah."},
+		{"2012-05-02", "John Doe", "* Tagging AthenaKernel-01-02-04"},
+		{"2012-04-30", "John Doe", "* XAthenaKernel-01-02-03 and AthenaKernel-01-02-03-01: unrelated."},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry #%d:\ngot:  %+v\nwant: %+v", i, entries[i], want[i])
+		}
+	}
+}
+
+func TestMentionsTag(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want bool
+	}{
+		{"Foo-01-02-03", true},
+		{"Tagging Foo-01-02-03.", true},
+		{"Tagging Foo-01-02-03\n", true},
+		{"(Foo-01-02-03)", true},
+		{"Control/Foo-01-02-03", true},
+		{"Foo-01-02-030", false},
+		{"Foo-01-02-03-01", false},
+		{"Foo-01-02-03-rc", true},
+		{"XFoo-01-02-03", false},
+		{"X_Foo-01-02-03", false},
+		{"1Foo-01-02-03", false},
+		{"XFoo-01-02-03 then Foo-01-02-03", true},
+		{"Foo-01-02-03-01 then Foo-01-02-03", true},
+		{"Foo-01-02", false},
+		{"", false},
+	} {
+		got := mentions_tag(tc.text, "Foo-01-02-03")
+		if got != tc.want {
+			t.Errorf("mentions_tag(%q) = %v, want %v", tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestChangeLogBetween(t *testing.T) {
+	entries, err := ParseChangeLog(strings.NewReader(testChangeLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		old, new string
+		want     []string // dates of the selected entries
+		found    bool
+	}{
+		{"AthenaKernel-01-02-04", "AthenaKernel-01-02-06", []string{"2012-06-14", "2012-06-12"}, true},
+		{"AthenaKernel-01-02-05", "AthenaKernel-01-02-06", []string{"2012-06-14"}, true},
+		{"", "AthenaKernel-01-02-05", []string{"2012-06-12"}, true},
+		{"", "AthenaKernel-01-02-07", nil, false},
+		{"AthenaKernel-01-02-05", "AthenaKernel-01-02-07", []string{"2012-06-14"}, false},
+		// neither XAthenaKernel-01-02-03 nor AthenaKernel-01-02-03-01 is the old tag
+		{"AthenaKernel-01-02-03", "AthenaKernel-01-02-05", []string{"2012-06-12", "2012-05-02", "2012-04-30"}, true},
+	} {
+		got, found := changelog_between(entries, tc.old, tc.new)
+		dates := make([]string, 0, len(got))
+		for _, e := range got {
+			dates = append(dates, e.Date)
+		}
+		if found != tc.found || strings.Join(dates, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s -> %s: got %v (found=%v), want %v (found=%v)", tc.old, tc.new, dates, found, tc.want, tc.found)
+		}
+	}
+}
+
+func TestMarkdownFence(t *testing.T) {
+	for _, tc := range []struct {
+		text string
+		want string
+	}{
+		{"no backticks", "```"},
+		{"`code`", "```"},
+		{"``code``", "```"},
+		{"```code```", "````"},
+		{"a ```` b ` c", "`````"},
+	} {
+		if got := md_fence(tc.text); got != tc.want {
+			t.Errorf("md_fence(%q) = %q, want %q", tc.text, got, tc.want)
+		}
+	}
+
+	notes := &ReleaseNotes{
+		Old: "rel_1",
+		New: "rel_2",
+		Projects: []ProjectNotes{{
+			Name: "AtlasCore",
+			Packages: []PackageNotes{{
+				Entry: TagDiffEntry{
+					Name: "Control/AthenaKernel",
+					Kind: VersionChanged,
+					Old:  Package{"Control/AthenaKernel", "AthenaKernel-01-02-05", "AtlasCore"},
+					New:  Package{"Control/AthenaKernel", "AthenaKernel-01-02-06", "AtlasCore"},
+				},
+				ChangeLog: []ChangeLogEntry{{"2012-06-14", "Jane Roe", "use ```std::move```"}},
+			}},
+		}},
+	}
+	buf := new(bytes.Buffer)
+	err := notes.WriteMarkdown(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n````\nuse ```std::move```\n````\n") {
+		t.Fatalf("ChangeLog entry not fenced:\n%s", buf.String())
+	}
+}
+
+// EOF
@@ -0,0 +1,286 @@
+package cmt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecipeEntry is a package to check out at a given version
+type RecipeEntry struct {
+	Package string // package full name (e.g. Control/AthenaKernel)
+	Version string // tag or branch to check out ("" for the trunk)
+}
+
+// Recipe is a list of packages to check out
+type Recipe []RecipeEntry
+
+// ReadRecipe reads a recipe in the pkgco format: one package per line,
+// as "<package> [<tag>]" or as a bare tag, with or without the package
+// path (e.g. AthenaKernel-01-02-03 or Control/AthenaKernel-01-02-03).
+// Empty lines and lines starting with '#' are ignored.
+func ReadRecipe(r io.Reader) (Recipe, error) {
+	rec := make(Recipe, 0)
+	scan := bufio.NewScanner(r)
+	for i := 1; scan.Scan(); i++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch len(fields) {
+		case 1:
+			e := RecipeEntry{Package: fields[0]}
+			if t, err := ParseTag(fields[0]); err == nil && t.Package != "" && !t.CMT {
+				// Control/AthenaKernel-01-02-03 is the tag AthenaKernel-01-02-03
+				// of Control/AthenaKernel
+				e = RecipeEntry{Package: t.Package, Version: pkg_basename(fields[0])}
+			}
+			rec = append(rec, e)
+		case 2:
+			rec = append(rec, RecipeEntry{Package: fields[0], Version: fields[1]})
+		default:
+			return nil, fmt.Errorf("cmt: malformed recipe line %d: %q", i, line)
+		}
+	}
+	return rec, scan.Err()
+}
+
+// LoadRecipe reads a recipe from the file `fname`
+func LoadRecipe(fname string) (Recipe, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecipe(f)
+}
+
+// Write writes the recipe in the pkgco format into `w`
+func (rec Recipe) Write(w io.Writer) error {
+	for _, e := range rec {
+		line := e.Package
+		if e.Version != "" {
+			line += " " + e.Version
+		}
+		_, err := fmt.Fprintln(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckoutStatus is the status of the checkout of a package
+type CheckoutStatus int
+
+const (
+	CheckoutStarted CheckoutStatus = iota // checkout in progress
+	CheckoutOK                            // package checked out
+	CheckoutFailed                        // checkout failed
+	CheckoutSkipped                       // package already present at the requested version
+)
+
+func (st CheckoutStatus) String() string {
+	switch st {
+	case CheckoutStarted:
+		return "started"
+	case CheckoutOK:
+		return "ok"
+	case CheckoutFailed:
+		return "failed"
+	case CheckoutSkipped:
+		return "skipped"
+	}
+	return fmt.Sprintf("CheckoutStatus(%d)", int(st))
+}
+
+// CheckoutResult is the outcome of the checkout of a package
+type CheckoutResult struct {
+	Entry    RecipeEntry    // the requested package (with its full name)
+	Dir      string         // directory of the package
+	Status   CheckoutStatus // status of the checkout
+	Err      error          // error (with the output of the VCS) of failed checkouts
+	Duration time.Duration  // duration of the checkout
+}
+
+// CheckoutOptions configures bulk checkouts
+type CheckoutOptions struct {
+	Dir  string // directory to check packages out into (default: the TestArea)
+	Jobs int    // maximum number of concurrent checkouts (default: 1)
+
+	// Progress, if not nil, is called when the checkout of a package starts
+	// and when it completes, with the number of completed packages.
+	// Calls are serialized.
+	Progress func(r CheckoutResult, done, total int)
+}
+
+// CheckoutSummary is the outcome of a bulk checkout
+type CheckoutSummary struct {
+	Results []CheckoutResult // results, in recipe order
+}
+
+func (sum *CheckoutSummary) select_status(st CheckoutStatus) []CheckoutResult {
+	out := make([]CheckoutResult, 0)
+	for _, r := range sum.Results {
+		if r.Status == st {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// Succeeded returns the packages which were checked out
+func (sum *CheckoutSummary) Succeeded() []CheckoutResult {
+	return sum.select_status(CheckoutOK)
+}
+
+// Failed returns the packages which could not be checked out
+func (sum *CheckoutSummary) Failed() []CheckoutResult {
+	return sum.select_status(CheckoutFailed)
+}
+
+// Skipped returns the packages which were already present at the requested version
+func (sum *CheckoutSummary) Skipped() []CheckoutResult {
+	return sum.select_status(CheckoutSkipped)
+}
+
+// Err returns the errors of the failed checkouts (nil if none failed)
+func (sum *CheckoutSummary) Err() error {
+	errs := make([]error, 0)
+	for _, r := range sum.Failed() {
+		errs = append(errs, fmt.Errorf("%s: %v", r.Entry.Package, r.Err))
+	}
+	return combineErrors(errs...)
+}
+
+// Write writes a human readable summary into `w`
+func (sum *CheckoutSummary) Write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "::: checked out: %d, skipped: %d, failed: %d\n",
+		len(sum.Succeeded()), len(sum.Skipped()), len(sum.Failed()),
+	)
+	if err != nil {
+		return err
+	}
+	for _, r := range sum.Failed() {
+		fmt.Fprintf(w, "**error** %s (%s): %v\n", r.Entry.Package, or_dash(r.Entry.Version), r.Err)
+	}
+	return nil
+}
+
+// BulkCheckOut checks out the packages of the recipe, with at most
+// opts.Jobs concurrent checkouts.
+// Packages already present at the requested version are skipped, and
+// failures do not stop the other checkouts: they are reported in the
+// summary. The returned error is only about the setup of the checkout.
+func (cmt *Cmt) BulkCheckOut(rec Recipe, opts CheckoutOptions) (*CheckoutSummary, error) {
+	if opts.Dir == "" {
+		opts.Dir = cmt.env.TestArea()
+	}
+	if opts.Jobs <= 0 {
+		opts.Jobs = 1
+	}
+	rules, err := cmt.RepoRules()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := &CheckoutSummary{Results: make([]CheckoutResult, len(rec))}
+	repos := make([]*Repository, len(rec))
+	done := 0
+	var mu sync.Mutex
+	progress := func(r CheckoutResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Status != CheckoutStarted {
+			done++
+		}
+		if opts.Progress != nil {
+			opts.Progress(r, done, len(rec))
+		}
+	}
+
+	// resolve packages and inspect the work area first: the accesses to
+	// the setup are serialized, so workers only run the checkouts.
+	for i, e := range rec {
+		res := &sum.Results[i]
+		if !strings.Contains(e.Package, "/") {
+			if p, err := cmt.Package(e.Package); err == nil {
+				e.Package = p.Name
+			}
+		}
+		res.Entry = e
+		res.Dir = filepath.Join(opts.Dir, filepath.FromSlash(e.Package))
+		if path_exists(res.Dir) {
+			lp := LocalPackage{Name: e.Package, Dir: res.Dir}
+			cmt.env.inspect_package(&lp)
+			if same_checkout_version(lp, e.Version) {
+				res.Status = CheckoutSkipped
+			} else {
+				res.Status = CheckoutFailed
+				res.Err = fmt.Errorf("cmt: already checked out at [%s] in [%s]", or_dash(lp.Version), res.Dir)
+			}
+			progress(*res)
+			continue
+		}
+		repos[i], res.Err = ResolveRepository(rules, e.Package, cmt.env)
+		if res.Err != nil {
+			res.Status = CheckoutFailed
+			progress(*res)
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.Jobs)
+	for i := range rec {
+		if repos[i] == nil || sum.Results[i].Err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(res *CheckoutResult, repo *Repository) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			res.Status = CheckoutStarted
+			progress(*res)
+			start := time.Now()
+			err := os.MkdirAll(filepath.Dir(res.Dir), 0755)
+			if err == nil {
+				err = repo.Checkout(res.Entry.Version, res.Dir)
+			}
+			res.Duration = time.Since(start)
+			if err != nil {
+				// do not leave a partial checkout behind
+				os.RemoveAll(res.Dir)
+				res.Status = CheckoutFailed
+				res.Err = err
+			} else {
+				res.Status = CheckoutOK
+			}
+			progress(*res)
+		}(&sum.Results[i], repos[i])
+	}
+	wg.Wait()
+	return sum, nil
+}
+
+// same_checkout_version returns whether the local package `lp` is checked
+// out at the version `version` ("" for the trunk)
+func same_checkout_version(lp LocalPackage, version string) bool {
+	if version == "" {
+		switch lp.Version {
+		case "trunk", "master", "main":
+			return true
+		}
+		return false
+	}
+	return lp.Version == version
+}
+
+// EOF
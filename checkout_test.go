@@ -0,0 +1,87 @@
+package cmt
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadRecipe(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want RecipeEntry
+		kind string // checkout_kind of the entry
+	}{
+		{"Control/AthenaKernel", RecipeEntry{"Control/AthenaKernel", ""}, "trunk"},
+		{"AthenaKernel", RecipeEntry{"AthenaKernel", ""}, "trunk"},
+		{"AthenaKernel-01-02-03", RecipeEntry{"AthenaKernel", "AthenaKernel-01-02-03"}, "tag"},
+		{"Control/AthenaKernel-01-02-03", RecipeEntry{"Control/AthenaKernel", "AthenaKernel-01-02-03"}, "tag"},
+		{"AthenaKernel-01-02-03-04", RecipeEntry{"AthenaKernel", "AthenaKernel-01-02-03-04"}, "tag"},
+		{"AthenaKernel-01-02-03-branch", RecipeEntry{"AthenaKernel", "AthenaKernel-01-02-03-branch"}, "branch"},
+		{"Control/AthenaKernel-01-02-03-branch", RecipeEntry{"Control/AthenaKernel", "AthenaKernel-01-02-03-branch"}, "branch"},
+		{"Control/AthenaKernel AthenaKernel-01-02-03", RecipeEntry{"Control/AthenaKernel", "AthenaKernel-01-02-03"}, "tag"},
+		{"Control/AthenaKernel trunk", RecipeEntry{"Control/AthenaKernel", "trunk"}, "trunk"},
+		{"Control/AthenaKernel AthenaKernel-01-02-03-branch", RecipeEntry{"Control/AthenaKernel", "AthenaKernel-01-02-03-branch"}, "branch"},
+		{"Control/AthenaKernel devel", RecipeEntry{"Control/AthenaKernel", "devel"}, "branch"},
+		{"  Control/AthenaKernel \t AthenaKernel-01-02-03  ", RecipeEntry{"Control/AthenaKernel", "AthenaKernel-01-02-03"}, "tag"},
+	} {
+		rec, err := ReadRecipe(strings.NewReader(tc.line))
+		if err != nil {
+			t.Errorf("%q: %v", tc.line, err)
+			continue
+		}
+		if len(rec) != 1 || rec[0] != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.line, rec, tc.want)
+			continue
+		}
+		if got := checkout_kind(rec[0].Package, rec[0].Version); got != tc.kind {
+			t.Errorf("%q: got a %s checkout, want %s", tc.line, got, tc.kind)
+		}
+	}
+
+	for _, line := range []string{
+		"Control/AthenaKernel AthenaKernel-01-02-03 extra",
+	} {
+		_, err := ReadRecipe(strings.NewReader(line))
+		if err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
+
+func TestRecipeRoundTrip(t *testing.T) {
+	rec, err := ReadRecipe(strings.NewReader(`# a recipe
+
+Control/AthenaKernel AthenaKernel-01-02-03
+  # indented comment
+Control/StoreGate
+Tracking/TrkEvent-00-10-00
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Recipe{
+		{"Control/AthenaKernel", "AthenaKernel-01-02-03"},
+		{"Control/StoreGate", ""},
+		{"Tracking/TrkEvent", "TrkEvent-00-10-00"},
+	}
+	if !reflect.DeepEqual(rec, want) {
+		t.Fatalf("got %+v, want %+v", rec, want)
+	}
+
+	buf := new(bytes.Buffer)
+	err = rec.Write(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ReadRecipe(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, want) {
+		t.Fatalf("round trip: got %+v, want %+v", again, want)
+	}
+}
+
+// EOF
@@ -0,0 +1,200 @@
+package cmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StaleAge is the age after which a setup directory without owner
+// information is considered stale by CleanupStale.
+var StaleAge = 24 * time.Hour
+
+const (
+	tmpdir_prefix = "atl-cmt-mgr-"       // prefix of all temporary directories
+	owner_fname   = ".atl-cmt-mgr.owner" // marker file recording the owner of a directory
+)
+
+// owner describes the process owning a setup directory
+type owner struct {
+	Pid     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// write_owner records the current process as the owner of `dir`
+func write_owner(dir string) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(owner{
+		Pid:     os.Getpid(),
+		Host:    host,
+		Created: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, owner_fname), data, 0644)
+}
+
+// read_owner returns the owner of `dir`
+func read_owner(dir string) (owner, error) {
+	var o owner
+	data, err := ioutil.ReadFile(filepath.Join(dir, owner_fname))
+	if err != nil {
+		return o, err
+	}
+	err = json.Unmarshal(data, &o)
+	return o, err
+}
+
+// registry of the Setups which have not been deleted yet
+var live = struct {
+	sync.Mutex
+	setups map[*Setup]struct{}
+}{
+	setups: make(map[*Setup]struct{}),
+}
+
+func track(s *Setup) {
+	live.Lock()
+	live.setups[s] = struct{}{}
+	live.Unlock()
+}
+
+// untrack removes s from the registry and marks it as deleted.
+// It returns false if s was already deleted, tracked or not.
+func untrack(s *Setup) bool {
+	live.Lock()
+	defer live.Unlock()
+	delete(live.setups, s)
+	if s.deleted {
+		return false
+	}
+	s.deleted = true
+	return true
+}
+
+// DeleteAll deletes all the Setups which have not been deleted yet
+func DeleteAll() error {
+	live.Lock()
+	setups := make([]*Setup, 0, len(live.setups))
+	for s := range live.setups {
+		setups = append(setups, s)
+	}
+	live.Unlock()
+
+	errs := make([]error, 0, len(setups))
+	for _, s := range setups {
+		errs = append(errs, s.Delete())
+	}
+	return combineErrors(errs...)
+}
+
+// HandleSignals installs a handler which deletes all the live Setups
+// (removing their temporary directories and subshells) when the process
+// receives SIGINT or SIGTERM, and then lets the signal terminate the process.
+// Calling the returned function uninstalls the handler.
+func HandleSignals() (stop func()) {
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-ch:
+			err := DeleteAll()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "**error** cleaning up setups: %v\n", err)
+			}
+			signal.Reset(sig)
+			p, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				err = p.Signal(sig)
+			}
+			if err == nil {
+				time.Sleep(time.Second)
+			}
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// CleanupStale removes the setup directories left over in `dir` (the default
+// temporary directory if empty) by processes which are gone.
+// Directories owned by a process still running, by a process on another
+// host, or by another user, are left alone. Directories without owner
+// information are removed once they are older than StaleAge.
+// Subshells are not looked for: they read their commands from the process
+// which started them, and exit with it.
+// If `dryrun` is true, nothing is removed.
+// CleanupStale returns the list of (to be) removed directories.
+func CleanupStale(dir string, dryrun bool) ([]string, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stale := make([]string, 0)
+	errs := make([]error, 0)
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), tmpdir_prefix) || !owned_by_user(fi) {
+			continue
+		}
+		fname := filepath.Join(dir, fi.Name())
+		if !is_stale(fname, fi, host) {
+			continue
+		}
+		stale = append(stale, fname)
+		if dryrun {
+			continue
+		}
+		errs = append(errs, os.RemoveAll(fname))
+	}
+	return stale, combineErrors(errs...)
+}
+
+// is_stale returns whether the setup directory `fname` can be removed
+func is_stale(fname string, fi os.FileInfo, host string) bool {
+	if !fi.IsDir() {
+		return time.Since(fi.ModTime()) > StaleAge
+	}
+	o, err := read_owner(fname)
+	if err != nil {
+		return time.Since(fi.ModTime()) > StaleAge
+	}
+	if o.Host != host {
+		return false
+	}
+	if o.Pid == os.Getpid() {
+		return false
+	}
+	return !process_alive(o.Pid)
+}
+
+// EOF
@@ -0,0 +1,127 @@
+// cmt-build builds the packages of the TestArea of the current CMT
+// environment in dependency order, in parallel, and reports the outcome of
+// each package build.
+//
+// Usage:
+//
+//	$ cmt-build [-j 4] [-k] [-pkgs Control/StoreGate,...] [-logs ./logs] [-json report.json] [-sarif diags.sarif]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	jobs    = flag.Int("j", 1, "maximum number of packages built concurrently")
+	keep    = flag.Bool("k", false, "keep going: build all the packages which do not depend on a failed one")
+	pkgs    = flag.String("pkgs", "", "comma-separated list of packages to build, with the ones they use (default: all)")
+	logdir  = flag.String("logs", "", "directory holding the build logs (default: $TestArea/build-logs)")
+	report  = flag.String("json", "", "file to write the JSON build report into")
+	makeopt = flag.String("make", "", "space-separated arguments of make (e.g. \"-j4\")")
+	sarif   = flag.String("sarif", "", "file to write the SARIF diagnostics of the failed packages into")
+)
+
+func main() {
+	flag.Parse()
+
+	// the first signal cancels the build, after which the setup is
+	// deleted; a second one deletes it right away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		cancel()
+		<-sigch
+		gocmt.DeleteAll()
+		os.Exit(1)
+	}()
+
+	ok, err := build(ctx)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// build builds the work area and writes the reports, and returns whether
+// all the packages were built
+func build(ctx context.Context) (bool, error) {
+	c, err := gocmt.New(nil)
+	if err != nil {
+		return false, err
+	}
+	defer c.Delete()
+
+	wa, err := c.WorkArea()
+	if err != nil {
+		return false, err
+	}
+
+	opts := gocmt.BuildOptions{
+		Jobs:   *jobs,
+		LogDir: *logdir,
+		Make:   strings.Fields(*makeopt),
+		Progress: func(r gocmt.BuildResult, done, total int) {
+			fmt.Printf("[%3d/%3d] %-7s %s\n", done, total, r.Status, r.Package)
+		},
+	}
+	if *keep {
+		opts.Policy = gocmt.ContinueOnFailure
+	}
+	if *pkgs != "" {
+		opts.Packages = strings.Split(*pkgs, ",")
+	}
+
+	rep, err := wa.Build(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+	rep.Write(os.Stdout)
+
+	if *report != "" {
+		f, err := os.Create(*report)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		err = rep.WriteJSON(f)
+		if err != nil {
+			return false, err
+		}
+	}
+	if *sarif != "" {
+		diags, err := wa.LogAnalyzer().AnalyzeReport(rep)
+		if err != nil {
+			return false, err
+		}
+		f, err := os.Create(*sarif)
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		err = gocmt.WriteSARIF(f, diags, wa.Dir)
+		if err != nil {
+			return false, err
+		}
+	}
+	return len(rep.Failed())+len(rep.Skipped()) == 0, nil
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "**error** "+format, args...)
+	os.Exit(1)
+}
+
+// EOF
@@ -0,0 +1,83 @@
+// cmt-checkout checks out a list of packages into the TestArea of the
+// current CMT environment, concurrently.
+//
+// Usage:
+//
+//	$ cmt-checkout [-j 4] [-dir ./WorkArea] recipe.txt
+//	$ cmt-checkout Control/AthenaKernel AthenaServices-01-60-22
+//
+// Recipes list one package per line, as "<package> [<tag>]" or as a bare tag.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	jobs    = flag.Int("j", 4, "maximum number of concurrent checkouts")
+	dir     = flag.String("dir", "", "directory to check packages out into (default: $TestArea)")
+	verbose = flag.Bool("v", false, "enable verbose mode")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 1 {
+		fmt.Fprintf(os.Stderr, "usage: cmt-checkout [-j 4] [-dir ./WorkArea] <recipe-file|package...>\n")
+		os.Exit(2)
+	}
+
+	rec, err := read_recipe(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+
+	stop := gocmt.HandleSignals()
+	defer stop()
+
+	c, err := gocmt.New(nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+
+	sum, err := c.BulkCheckOut(rec, gocmt.CheckoutOptions{
+		Dir:  *dir,
+		Jobs: *jobs,
+		Progress: func(r gocmt.CheckoutResult, done, total int) {
+			if r.Status == gocmt.CheckoutStarted && !*verbose {
+				return
+			}
+			fmt.Printf("[%3d/%3d] %-7s %s %s\n", done, total, r.Status, r.Entry.Package, r.Entry.Version)
+		},
+	})
+	// os.Exit does not run deferred calls
+	c.Delete()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+
+	sum.Write(os.Stdout)
+	if len(sum.Failed()) > 0 {
+		os.Exit(1)
+	}
+}
+
+// read_recipe reads the recipe file `args[0]`, or builds a recipe from
+// the packages and tags given on the command line
+func read_recipe(args []string) (gocmt.Recipe, error) {
+	if len(args) == 1 {
+		if fi, err := os.Stat(args[0]); err == nil && fi.Mode().IsRegular() {
+			return gocmt.LoadRecipe(args[0])
+		}
+	}
+	return gocmt.ReadRecipe(strings.NewReader(strings.Join(args, "\n")))
+}
+
+// EOF
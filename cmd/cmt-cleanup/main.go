@@ -0,0 +1,41 @@
+// cmt-cleanup removes the setup directories left over by crashed or killed
+// programs using github.com/atlas-org/cmt.
+//
+// Usage:
+//
+//	$ cmt-cleanup [-dir /tmp] [-n] [-v]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	dir     = flag.String("dir", "", "directory to clean up (default: $TMPDIR)")
+	dryrun  = flag.Bool("n", false, "dry run: only print the directories which would be removed")
+	verbose = flag.Bool("v", false, "enable verbose mode")
+)
+
+func main() {
+	flag.Parse()
+
+	dirs, err := gocmt.CleanupStale(*dir, *dryrun)
+	if *verbose || *dryrun {
+		for _, d := range dirs {
+			fmt.Printf("::: stale [%s]\n", d)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+	if *verbose {
+		fmt.Printf("::: removed [%d] stale directories\n", len(dirs))
+	}
+}
+
+// EOF
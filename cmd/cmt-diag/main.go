@@ -0,0 +1,102 @@
+// cmt-diag extracts the compiler, linker and CMT diagnostics of build logs
+// (of 'cmt make', 'cmt broadcast' or cmt-build), attributes them to the
+// packages of the TestArea of the current CMT environment (or of the
+// current directory), and writes them as text, JSON or SARIF (for CI
+// annotations).
+//
+// Usage:
+//
+//	$ cmt-diag [-format text|json|sarif] [-o out.sarif] [-srcroot $TestArea] build.log [...]
+//	$ cmt make 2>&1 | cmt-diag -format json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	format  = flag.String("format", "text", "output format (text, json or sarif)")
+	output  = flag.String("o", "", "file to write the diagnostics into (default: stdout)")
+	srcroot = flag.String("srcroot", "", "directory SARIF locations are relative to (default: $TestArea)")
+	werror  = flag.Bool("werror", false, "exit with a non-zero status on warnings too")
+)
+
+func main() {
+	flag.Parse()
+
+	a := &gocmt.LogAnalyzer{}
+	root := *srcroot
+	var wa *gocmt.WorkArea
+	c, err := gocmt.New(nil)
+	if err == nil {
+		// the setup is only needed to locate the packages
+		wa, err = c.WorkArea()
+		c.Delete()
+	}
+	if err == nil {
+		a = wa.LogAnalyzer()
+		if root == "" {
+			root = wa.Dir
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**warning** diagnostics will not be attributed to packages: %v\n", err)
+	}
+
+	diags := make([]gocmt.Diagnostic, 0)
+	if flag.NArg() == 0 {
+		diags, err = a.Parse(os.Stdin)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+	}
+	for _, fname := range flag.Args() {
+		ds, err := a.ParseFile(fname)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+		diags = append(diags, ds...)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch *format {
+	case "text":
+		err = gocmt.WriteDiagnosticsText(w, diags)
+	case "json":
+		err = gocmt.WriteDiagnosticsJSON(w, diags)
+	case "sarif":
+		err = gocmt.WriteSARIF(w, diags, root)
+	default:
+		fatalf("unknown format [%s]\n", *format)
+	}
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+
+	for _, d := range diags {
+		if d.Severity == "error" || (*werror && d.Severity == "warning") {
+			os.Exit(1)
+		}
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "**error** "+format, args...)
+	os.Exit(1)
+}
+
+// EOF
@@ -0,0 +1,49 @@
+// cmt-manifest captures the manifest of a release (its projects and the tags
+// of all its packages) so it can be archived and diffed later on.
+//
+// Usage:
+//
+//	$ cmt-manifest [-o manifest.json] [-v] rel_1,devval
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	output  = flag.String("o", "", "output file (default: stdout)")
+	verbose = flag.Bool("v", false, "enable verbose mode")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: cmt-manifest [-o manifest.json] [-v] <asetup-tags>\n")
+		os.Exit(2)
+	}
+
+	stop := gocmt.HandleSignals()
+	defer stop()
+
+	m, err := gocmt.LoadRelease(flag.Arg(0), *verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+
+	if *output != "" {
+		err = m.Save(*output)
+	} else {
+		err = m.Write(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// EOF
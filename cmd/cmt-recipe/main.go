@@ -0,0 +1,118 @@
+// cmt-recipe generates checkout recipes (one "<package> <tag>" per line,
+// as consumed by cmt-checkout and pkgco).
+//
+// Usage:
+//
+//	$ cmt-recipe -diff rel_3,devval rel_4,devval            # packages whose tag changed
+//	$ cmt-recipe -impact -projects AtlasEvent rel_3,devval rel_4,devval
+//	$ cmt-recipe -clients -projects AtlasEvent Control/AthenaKernel
+//	$ cmt-recipe -uses -depth 1 Control/StoreGate
+//
+// Dependency queries (-impact, -clients, -uses) run against the release of
+// the current CMT environment.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	diff     = flag.Bool("diff", false, "select the packages whose tag changed between two releases")
+	impact   = flag.Bool("impact", false, "like -diff, plus the packages of the current release using them")
+	clients  = flag.Bool("clients", false, "select the packages using the given packages")
+	uses     = flag.Bool("uses", false, "select the packages used by the given packages")
+	depth    = flag.Int("depth", 0, "maximum number of dependency levels (0: no limit)")
+	projects = flag.String("projects", "", "comma-separated list of projects to select dependencies from")
+	output   = flag.String("o", "", "output file (default: stdout)")
+	verbose  = flag.Bool("v", false, "enable verbose mode")
+)
+
+func main() {
+	flag.Parse()
+
+	stop := gocmt.HandleSignals()
+	defer stop()
+
+	rec, err := make_recipe()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		w, err = os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+			os.Exit(1)
+		}
+		defer w.Close()
+	}
+	err = rec.Write(w)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "**error** %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func make_recipe() (gocmt.Recipe, error) {
+	projs := split_list(*projects)
+	switch {
+	case *diff || *impact:
+		if flag.NArg() != 2 {
+			usage()
+		}
+		r, err := gocmt.DiffReleases(flag.Arg(0), flag.Arg(1), gocmt.TagDiffOptions{Verbose: *verbose})
+		if err != nil {
+			return nil, err
+		}
+		if *diff {
+			return gocmt.RecipeFromTagDiff(r), nil
+		}
+		c, err := gocmt.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Delete()
+		return c.ImpactRecipe(r, projs)
+
+	case *clients || *uses:
+		if flag.NArg() < 1 {
+			usage()
+		}
+		c, err := gocmt.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Delete()
+		return c.QueryRecipe(gocmt.DependencyQuery{
+			Packages: flag.Args(),
+			Clients:  *clients,
+			Uses:     *uses,
+			Depth:    *depth,
+			Projects: projs,
+		})
+	}
+	usage()
+	return nil, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: cmt-recipe (-diff|-impact) <old-release> <new-release>\n")
+	fmt.Fprintf(os.Stderr, "       cmt-recipe (-clients|-uses) [-depth N] <package...>\n")
+	os.Exit(2)
+}
+
+func split_list(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// EOF
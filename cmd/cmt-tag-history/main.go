@@ -0,0 +1,131 @@
+// cmt-tag-history queries a directory of archived release manifests
+// (as produced by cmt-manifest).
+//
+// Usage:
+//
+//	$ cmt-tag-history -dir ./manifests -pkg Control/AthenaKernel [-branch devval]
+//	$ cmt-tag-history -dir ./manifests -branch devval -from 2014-03-03 -to 2014-03-06 [-format markdown]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	dir    = flag.String("dir", ".", "directory holding the release manifests")
+	pkg    = flag.String("pkg", "", "package to display the tag history of")
+	branch = flag.String("branch", "", "restrict to that nightly branch")
+	from   = flag.String("from", "", "start date (YYYY-MM-DD)")
+	to     = flag.String("to", "", "end date (YYYY-MM-DD), inclusive")
+	format = flag.String("format", "text", "output format ("+strings.Join(gocmt.Formats, ", ")+")")
+
+	projects = flag.String("projects", "", "comma-separated list of projects to report")
+	pkgs     = flag.String("pkgs", "", "comma-separated list of package glob patterns to report (e.g. Tracking/*)")
+	kinds    = flag.String("kinds", "", "comma-separated list of kinds of changes to report (added, removed, changed, moved)")
+	noext    = flag.Bool("no-externals", false, "do not report externals and policy packages")
+)
+
+func main() {
+	flag.Parse()
+
+	h, err := gocmt.NewTagHistory(*dir)
+	if err != nil {
+		fatalf("could not index manifests: %v\n", err)
+	}
+
+	if *pkg != "" {
+		display_timeline(h)
+		return
+	}
+
+	beg, err := parse_date(*from)
+	if err != nil {
+		fatalf("invalid -from date: %v\n", err)
+	}
+	end, err := parse_date(*to)
+	if err != nil {
+		fatalf("invalid -to date: %v\n", err)
+	}
+	if !end.IsZero() {
+		end = end.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	filter := &gocmt.TagDiffFilter{
+		Projects:    split_list(*projects),
+		Packages:    split_list(*pkgs),
+		NoExternals: *noext,
+	}
+	for _, name := range split_list(*kinds) {
+		k, err := gocmt.ParseChangeKind(name)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+		filter.Kinds = append(filter.Kinds, k)
+	}
+
+	r := h.ChangedBetween(*branch, beg, end, gocmt.TagDiffOptions{Filter: filter})
+	if r == nil {
+		fatalf("less than 2 releases of branch [%s] in the date range\n", *branch)
+	}
+	ren, err := gocmt.NewRenderer(*format)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	err = ren.RenderTagDiff(os.Stdout, r)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+}
+
+func display_timeline(h *gocmt.TagHistory) {
+	fmt.Printf("::: tags of [%s]:\n", *pkg)
+	for _, span := range h.Timeline(*pkg, *branch) {
+		fmt.Printf("%-35s %-15s %s -> %s %v\n",
+			span.Tag, span.Project,
+			span.FirstSeen.Format("2006-01-02"),
+			span.LastSeen.Format("2006-01-02"),
+			span.Releases,
+		)
+	}
+	fmt.Printf("::: changes of [%s]:\n", *pkg)
+	for _, c := range h.PackageChanges(*pkg, *branch) {
+		fmt.Printf("%s %-25s %-35s -> %s\n",
+			c.Date.Format("2006-01-02"), c.Release,
+			or_none(c.Old.Version), or_none(c.New.Version),
+		)
+	}
+}
+
+func parse_date(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", v)
+}
+
+func split_list(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return strings.Split(v, ",")
+}
+
+func or_none(v string) string {
+	if v == "" {
+		return "None"
+	}
+	return v
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "**error** "+format, args...)
+	os.Exit(1)
+}
+
+// EOF
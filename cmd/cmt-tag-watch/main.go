@@ -0,0 +1,78 @@
+// cmt-tag-watch periodically diffs the latest nightly against the previous
+// one (or a pinned reference manifest) and POSTs the tag changes to webhooks.
+//
+// Usage:
+//
+//	$ cmt-tag-watch -release latest,devval -subs hooks.json [-ref ref.json] [-state ~/.cmt-tag-watch] [-interval 1h] [-once]
+//
+// where hooks.json holds the list of subscriptions:
+//
+//	[
+//	  {"url": "http://example.org/hook", "projects": ["AtlasReconstruction"], "packages": ["Tracking/*"]}
+//	]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	gocmt "github.com/atlas-org/cmt"
+)
+
+var (
+	release  = flag.String("release", "latest,devval", "release to watch (asetup tags or manifest file)")
+	ref      = flag.String("ref", "", "pinned reference manifest (default: previously seen release)")
+	subs     = flag.String("subs", "hooks.json", "JSON file holding the list of subscriptions")
+	state    = flag.String("state", filepath.Join(os.Getenv("HOME"), ".cmt-tag-watch"), "directory holding the state of the watcher")
+	interval = flag.Duration("interval", time.Hour, "time between polls")
+	retries  = flag.Int("retries", 3, "number of retries of failed deliveries")
+	once     = flag.Bool("once", false, "poll only once")
+	verbose  = flag.Bool("v", false, "enable verbose mode")
+)
+
+func main() {
+	flag.Parse()
+
+	stop := gocmt.HandleSignals()
+	defer stop()
+
+	w := &gocmt.Watcher{
+		Release:   *release,
+		Reference: *ref,
+		StateDir:  *state,
+		Interval:  *interval,
+		Retries:   *retries,
+		Verbose:   *verbose,
+	}
+
+	f, err := os.Open(*subs)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	err = json.NewDecoder(f).Decode(&w.Subscriptions)
+	f.Close()
+	if err != nil {
+		fatalf("invalid subscriptions file [%s]: %v\n", *subs, err)
+	}
+
+	if *once {
+		err = w.Poll(context.Background())
+	} else {
+		err = w.Run(context.Background())
+	}
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "**error** "+format, args...)
+	os.Exit(1)
+}
+
+// EOF
@@ -6,59 +6,84 @@ import (
 	"encoding/xml"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gonuts/logger"
 )
 
 type Cmt struct {
-	env *Setup // environment configured for cmt
-	bin string // path to cmt.exe
-	msg *logger.Logger
+	env   *Setup // environment configured for cmt
+	owned bool   // whether env was created by New, and is deleted by Delete
+	bin   string // path to cmt.exe
+	msg   *logger.Logger
 }
 
+// New returns a Cmt running in the environment `env`.
+// If `env` is nil, the current environment is used, through a new Setup
+// which must be released with Delete.
 func New(env *Setup) (*Cmt, error) {
 	var err error
+	owned := false
+	fail := func(err error) (*Cmt, error) {
+		if owned {
+			env.Delete()
+		}
+		return nil, err
+	}
 	if env == nil {
 		verbose := false
 		env, err = newSetup("<local>", "", "", verbose)
 		if err != nil {
 			return nil, err
 		}
+		owned = true
 		pwd := env.topdir
 		pwd, err = os.Getwd()
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
 		err = env.sh.Chdir(pwd)
 		if err != nil {
-			return nil, err
+			return fail(err)
 		}
 	}
 
 	out, err := env.sh.Run("which", "cmt.exe")
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	bin := string(bytes.Trim(out, "\n"))
 
 	cmt := &Cmt{
-		env: env,
-		bin: bin,
-		msg: logger.New("cmt"),
+		env:   env,
+		owned: owned,
+		bin:   bin,
+		msg:   logger.New("cmt"),
 	}
 
 	dag, err := cmt.ProjectsDag()
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
 	if len(dag) <= 0 {
-		return nil, fmt.Errorf("cmt: no projects found. corrupted CMT environment ?")
+		return fail(fmt.Errorf("cmt: no projects found. corrupted CMT environment ?"))
 	}
 	return cmt, nil
 }
 
+// Delete releases the environment created by New.
+// Environments given to New are left to their owner.
+func (cmt *Cmt) Delete() error {
+	if !cmt.owned {
+		return nil
+	}
+	return cmt.env.Delete()
+}
+
 // CheckOut checks out the package 'pkg' with revision 'version'.
 //  pkg is the fullname of the package. e.g. Control/AthenaKernel
 //  version can be empty to mean the HEAD or trunk or master
@@ -123,7 +148,11 @@ func (cmt *Cmt) PackageVersion(pkg string) string {
 		if area != "" && bytes.Index(line, []byte(area)) != -1 {
 			continue
 		}
-		version = bytes.Split(line, []byte(" "))[1]
+		fields := bytes.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		version = fields[1]
 		break
 	}
 	return string(version)
@@ -313,48 +342,113 @@ func (cmt *Cmt) Package(name string) (*Package, error) {
 	return nil, fmt.Errorf("cmt: package [%s] not found", name)
 }
 
+// PackageTag is a tag of a package in its repository
+type PackageTag struct {
+	Tag
+	Name     string    // name of the tag in the repository
+	Revision int       // revision of the last commit of the tag
+	Author   string    // author of the last commit of the tag
+	Date     time.Time // date of the last commit of the tag
+}
+
+// PackageTags returns the tags of `pkg` following the ATLAS convention,
+// sorted from the oldest to the most recent one
+func (cmt *Cmt) PackageTags(pkg string) ([]PackageTag, error) {
+	repo, err := cmt.Repository(pkg)
+	if err != nil {
+		return nil, err
+	}
+	cmt.debugf("listing tags of [%s] in [%s]...\n", pkg, repo.URL)
+	return repo.Tags()
+}
+
 // LatestPackageTag returns the most recent SVN tag of `pkg`
 func (cmt *Cmt) LatestPackageTag(pkg string) (string, error) {
-	svnroot := cmt.env.sh.Getenv("SVNROOT")
-	if svnroot == "" {
-		return "", fmt.Errorf("cmt: SVNROOT not set")
+	return cmt.LatestPackageTagIn(pkg, "")
+}
+
+// LatestPackageTagIn returns the most recent SVN tag of `pkg` in the
+// series `series` (e.g. "01-02-*" selects the tags of the 01-02 series).
+// An empty series selects all the tags. Branch tags are never selected.
+func (cmt *Cmt) LatestPackageTagIn(pkg, series string) (string, error) {
+	tags, err := cmt.PackageTags(pkg)
+	if err != nil {
+		return "", err
 	}
-	args := []string{"ls", strings.Join([]string{svnroot, pkg, "tags"}, "/")}
-	if strings.HasPrefix(pkg, "Gaudi") {
-		svnroot = cmt.env.sh.Getenv("GAUDISVN")
-		if svnroot == "" {
-			svnroot = "http://svnweb.cern.ch/guest/gaudi"
+	for i := len(tags) - 1; i >= 0; i-- {
+		t := tags[i]
+		if t.Branch || !match_series(t.Tag, series) {
+			continue
 		}
-		args = []string{"ls", strings.Join([]string{svnroot, "Gaudi", "tags", pkg}, "/")}
+		return t.Name, nil
 	}
-	cmt.debugf("running svn %v...\n", args)
-	bout, err := cmt.env.sh.Run("svn", args...)
-	if err != nil {
-		return "", fmt.Errorf("cmt: error running svn %v:\nout:\n%v\nerr: %v",
-			args,
-			string(bout),
-			err,
-		)
+	if series != "" {
+		return "", fmt.Errorf("cmt: no tag of package [%s] in series [%s]", pkg, series)
 	}
-	tags := []string{}
-	for _, bline := range bytes.Split(bout, []byte("\n")) {
-		bline = bytes.Trim(bline, " \n")
-		tags = append(tags, string(bline))
+	return "", fmt.Errorf("cmt: no tag of package [%s]", pkg)
+}
+
+// parse_svn_tags parses the output of 'svn ls --xml' and returns the
+// tags of `pkg` it lists, sorted by ATLAS ordering.
+// Entries which are not tags of `pkg` (e.g. tags of similarly prefixed
+// packages) are ignored.
+func parse_svn_tags(data []byte, pkg string) ([]PackageTag, error) {
+	var doc struct {
+		Entries []struct {
+			Name   string `xml:"name"`
+			Commit struct {
+				Revision int    `xml:"revision,attr"`
+				Author   string `xml:"author"`
+				Date     string `xml:"date"`
+			} `xml:"commit"`
+		} `xml:"list>entry"`
 	}
-	if len(tags) <= 0 {
-		return "", fmt.Errorf("cmt: empty %s SVN directory", args[1])
+	err := xml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
 	}
 
 	bname := filepath.Base(pkg)
-
-	// enforce atlas convention of tags (pkgname-xx-yy-zz-ww)
-	tag := ""
-	for _, t := range tags {
-		if strings.HasPrefix(t, bname+"-") {
-			tag = strings.Trim(t, " /\r\n")
+	tags := make([]PackageTag, 0, len(doc.Entries))
+	for _, e := range doc.Entries {
+		// enforce atlas convention of tags (pkgname-xx-yy-zz-ww)
+		t, err := ParseTag(e.Name)
+		if err != nil || t.Validate(bname) != nil {
+			continue
+		}
+		tag := PackageTag{
+			Tag:      t,
+			Name:     e.Name,
+			Revision: e.Commit.Revision,
+			Author:   e.Commit.Author,
 		}
+		if e.Commit.Date != "" {
+			tag.Date, _ = time.Parse(time.RFC3339Nano, e.Commit.Date)
+		}
+		tags = append(tags, tag)
+	}
+	sort_package_tags(tags)
+	return tags, nil
+}
+
+// sort_package_tags sorts tags by ATLAS ordering
+func sort_package_tags(tags []PackageTag) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].Tag.Less(tags[j].Tag)
+	})
+}
+
+// match_series returns whether the tag `t` belongs to the series `series`,
+// a glob pattern matched against the tag without the package name
+// (e.g. "01-02-*"). An empty series matches all tags.
+func match_series(t Tag, series string) bool {
+	if series == "" {
+		return true
 	}
-	return tag, err
+	series = strings.TrimPrefix(series, t.Package+"-")
+	series = strings.TrimPrefix(series, "-")
+	ok, _ := path.Match(series, t.Short())
+	return ok
 }
 
 // EOF
@@ -0,0 +1,127 @@
+package cmt
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExitStatus describes how a process started from a Setup terminated
+type ExitStatus struct {
+	Code     int           // exit code of the process (-1 if it was killed by a signal)
+	Signal   os.Signal     // signal which killed the process (or nil)
+	Duration time.Duration // wall-clock time the process ran for
+}
+
+// Success returns whether the process exited with a zero exit code
+func (st ExitStatus) Success() bool {
+	return st.Code == 0 && st.Signal == nil
+}
+
+// ExitStatusOf returns the exit status of a command which has been waited for
+func ExitStatusOf(cmd *exec.Cmd) ExitStatus {
+	ps := cmd.ProcessState
+	if ps == nil {
+		return ExitStatus{Code: -1}
+	}
+	return ExitStatus{
+		Code:   ps.ExitCode(),
+		Signal: process_signal(ps),
+	}
+}
+
+// Environ returns a copy of the environment of the setup's subshell,
+// in the "key=value" form used by os/exec.
+func (s *Setup) Environ() []string {
+	environ := s.sh.Environ()
+	env := make([]string, 0, len(environ))
+	for _, kv := range environ {
+		if strings.HasPrefix(kv, "_=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// Command returns a command ready to run the program `name` with the
+// environment and working directory of the setup.
+// `name` is resolved against the PATH of the setup, not the one of the
+// current process.
+// The command runs in its own process group, which is killed as a whole
+// when `ctx` is done.
+func (s *Setup) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, s.lookPath(name), args...)
+	cmd.Env = s.Environ()
+	cmd.Dir = s.workdir()
+	set_process_group(cmd)
+	cmd.Cancel = func() error {
+		return kill_process_group(cmd.Process, syscall.SIGKILL)
+	}
+	return cmd
+}
+
+// Stream runs the program `name` with the environment and working directory
+// of the setup, connecting its standard streams to `stdin`, `stdout` and
+// `stderr` (which may be nil) as the program runs, and waits for its
+// completion.
+// A non-zero exit code is reported both in the returned ExitStatus and
+// as an *exec.ExitError.
+func (s *Setup) Stream(ctx context.Context, stdin io.Reader, stdout, stderr io.Writer, name string, args ...string) (ExitStatus, error) {
+	cmd := s.Command(ctx, name, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	status := ExitStatusOf(cmd)
+	status.Duration = time.Since(start)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return status, err
+}
+
+// Signal sends `sig` to the whole process group of a running command
+// created by Setup.Command
+func Signal(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return os.ErrInvalid
+	}
+	return kill_process_group(cmd.Process, sig)
+}
+
+// lookPath resolves `name` against the PATH of the setup's subshell
+func (s *Setup) lookPath(name string) string {
+	if strings.Contains(name, string(os.PathSeparator)) {
+		return name
+	}
+	for _, dir := range s.PathList("PATH") {
+		fname := filepath.Join(dir, name)
+		fi, err := os.Stat(fname)
+		if err != nil || fi.IsDir() {
+			continue
+		}
+		if fi.Mode()&0111 != 0 {
+			return fname
+		}
+	}
+	return name
+}
+
+// workdir returns the current working directory of the setup's subshell
+func (s *Setup) workdir() string {
+	wd, err := s.sh.Getwd()
+	if err != nil || wd == "" {
+		return s.topdir
+	}
+	return wd
+}
+
+// EOF
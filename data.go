@@ -8,9 +8,9 @@ import (
 
 // Package represents a CMT package.
 type Package struct {
-	Name    string // package full name
-	Version string // package version
-	Project string // name of the project this package lives in
+	Name    string `json:"name"`              // package full name
+	Version string `json:"version"`           // package version
+	Project string `json:"project,omitempty"` // name of the project this package lives in
 }
 
 // Base returns the basename of this package
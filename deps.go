@@ -0,0 +1,154 @@
+package cmt
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/gonuts/logger"
+)
+
+// DepGraph is the graph of the dependencies ('use' statements of the
+// cmt/requirements files) between packages
+type DepGraph struct {
+	Uses    map[string][]string // packages used by each package, sorted
+	Clients map[string][]string // packages using each package, sorted
+}
+
+// NewDepGraph builds the dependency graph of the packages `dirs`, indexed
+// by their full name, from their cmt/requirements files.
+// Used packages which are not in `dirs` are ignored.
+func NewDepGraph(dirs map[string]string) (*DepGraph, error) {
+	g := &DepGraph{
+		Uses:    make(map[string][]string, len(dirs)),
+		Clients: make(map[string][]string, len(dirs)),
+	}
+
+	// used packages may be given by basename only
+	bnames := make(map[string][]string, len(dirs))
+	for name := range dirs {
+		bname := path.Base(name)
+		bnames[bname] = append(bnames[bname], name)
+	}
+	resolve := func(name string) string {
+		name = filepath.ToSlash(name)
+		if _, ok := dirs[name]; ok {
+			return name
+		}
+		if cands := bnames[path.Base(name)]; len(cands) == 1 && !path_has_dir(name) {
+			return cands[0]
+		}
+		return ""
+	}
+
+	msg := logger.New("cmt")
+	for name, dir := range dirs {
+		fname := filepath.Join(dir, "cmt", "requirements")
+		if !path_exists(fname) {
+			continue
+		}
+		uses, err := extract_uses(fname, msg)
+		if err != nil {
+			return nil, err
+		}
+		for _, use := range uses {
+			dep := resolve(use.Name)
+			if dep == "" || dep == name {
+				continue
+			}
+			g.Uses[name] = append(g.Uses[name], dep)
+			g.Clients[dep] = append(g.Clients[dep], name)
+		}
+	}
+	for _, m := range []map[string][]string{g.Uses, g.Clients} {
+		for name := range m {
+			m[name] = uniq_strings(m[name])
+		}
+	}
+	return g, nil
+}
+
+// AllClients returns the packages using, directly or not, one of the
+// packages `pkgs`, up to `depth` levels (0: no limit), sorted.
+// The packages `pkgs` themselves are not returned.
+func (g *DepGraph) AllClients(pkgs []string, depth int) []string {
+	return closure(g.Clients, pkgs, depth)
+}
+
+// AllUses returns the packages used, directly or not, by one of the
+// packages `pkgs`, up to `depth` levels (0: no limit), sorted.
+// The packages `pkgs` themselves are not returned.
+func (g *DepGraph) AllUses(pkgs []string, depth int) []string {
+	return closure(g.Uses, pkgs, depth)
+}
+
+// closure returns the nodes reachable from `roots` in `edges`
+func closure(edges map[string][]string, roots []string, depth int) []string {
+	seen := make(map[string]bool, len(roots))
+	for _, name := range roots {
+		seen[name] = true
+	}
+	out := make([]string, 0)
+	cur := roots
+	for lvl := 1; len(cur) > 0 && (depth <= 0 || lvl <= depth); lvl++ {
+		next := make([]string, 0)
+		for _, name := range cur {
+			for _, dep := range edges[name] {
+				if seen[dep] {
+					continue
+				}
+				seen[dep] = true
+				out = append(out, dep)
+				next = append(next, dep)
+			}
+		}
+		cur = next
+	}
+	sort.Strings(out)
+	return out
+}
+
+// ReleaseDepGraph returns the manifest of the release of the setup and
+// the dependency graph of its packages
+func (cmt *Cmt) ReleaseDepGraph() (*Manifest, *DepGraph, error) {
+	release := cmt.env.Getenv("AtlasVersion")
+	if release == "" {
+		release = "release"
+	}
+	m, err := cmt.Manifest(release)
+	if err != nil {
+		return nil, nil, err
+	}
+	projs := m.ReleaseProjects()
+	dirs := make(map[string]string)
+	for name, p := range m.Packages() {
+		if dir := find_package_dir(projs, p); dir != "" {
+			dirs[name] = dir
+		}
+	}
+	g, err := NewDepGraph(dirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, g, nil
+}
+
+// path_has_dir returns whether the package name `name` has a parent directory
+func path_has_dir(name string) bool {
+	return path.Dir(name) != "."
+}
+
+// uniq_strings returns the sorted distinct values of `vs`
+func uniq_strings(vs []string) []string {
+	sort.Strings(vs)
+	out := vs[:0]
+	for i, v := range vs {
+		if i > 0 && v == vs[i-1] {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// EOF
@@ -0,0 +1,473 @@
+package cmt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is a diagnostic found in a build log
+type Diagnostic struct {
+	Kind     string     `json:"kind"`               // "compiler", "linker" or "cmt"
+	Rule     string     `json:"rule"`               // identifier of the kind of problem (e.g. "undefined-reference", "-Wunused-variable")
+	Severity string     `json:"severity"`           // "error", "warning" or "note"
+	File     string     `json:"file,omitempty"`     // file the diagnostic is about
+	Line     int        `json:"line,omitempty"`     // line in the file (0: unknown)
+	Column   int        `json:"column,omitempty"`   // column in the file (0: unknown)
+	Message  string     `json:"message"`            // text of the diagnostic
+	Package  string     `json:"package,omitempty"`  // package the diagnostic is attributed to
+	Included []Location `json:"included,omitempty"` // "In file included from" chain, innermost first
+	Notes    []Location `json:"notes,omitempty"`    // notes attached to the diagnostic
+	Log      string     `json:"log,omitempty"`      // build log the diagnostic was found in
+	LogLine  int        `json:"log_line"`           // line of the diagnostic in the build log
+	Count    int        `json:"count"`              // number of occurrences in the log
+}
+
+// Location is a location related to a diagnostic
+type Location struct {
+	File    string `json:"file"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// LogAnalyzer extracts diagnostics from the logs of 'cmt make', 'cmt
+// broadcast' and WorkArea.Build, and attributes them to packages
+type LogAnalyzer struct {
+	Packages map[string]string // directories of the packages diagnostics are attributed to, by full name
+}
+
+// LogAnalyzer returns a log analyzer attributing diagnostics to the
+// packages of the work area
+func (wa *WorkArea) LogAnalyzer() *LogAnalyzer {
+	a := &LogAnalyzer{Packages: make(map[string]string, len(wa.Packages))}
+	for _, p := range wa.Packages {
+		a.Packages[p.Name] = p.Dir
+	}
+	return a
+}
+
+var (
+	re_diag_compiler = regexp.MustCompile(`^(.+?):(\d+):(?:(\d+):)? (fatal error|error|warning|note): (.*)$`)
+	re_diag_included = regexp.MustCompile(`^(?:In file included from|\s+from) (.+?):(\d+)(?::(\d+))?[:,]$`)
+	re_diag_undefref = regexp.MustCompile("^(.+?):(?:(\\d+):|\\(\\S+\\):)? undefined reference to [`'](.+)'$")
+	re_diag_ld       = regexp.MustCompile(`^(?:\S*/)?ld(?:\.\w+)?: (?:error: |warning: )?(.*)$`)
+	re_diag_cmt      = regexp.MustCompile(`^#CMT-*> (Error|Warning|Fatal)\S*:? *(.*)$`)
+	re_diag_wflag    = regexp.MustCompile(`\s+\[(-W[^\]]+)\]$`)
+	re_diag_scope    = regexp.MustCompile(`^(?:\S*/)?(?:ld(?:\.\w+)?: )?\S+: (?:[Ii]n |At ).*:$`)
+	re_diag_ldprefix = regexp.MustCompile(`^(?:\S*/)?ld(?:\.\w+)?: `)
+
+	re_ctx_driver   = regexp.MustCompile(`^::: \[(\S+)\] `)
+	re_ctx_trying   = regexp.MustCompile(`^# Now trying \[.*\] in (\S+)`)
+	re_ctx_entering = regexp.MustCompile("^g?make(?:\\[\\d+\\])?: Entering directory [`'](.+)'$")
+	re_cmt_request  = regexp.MustCompile(`\(requested by ([^\s)]+)`)
+)
+
+// logContext is the package and directory a build log is processing
+type logContext struct {
+	pkg string
+	dir string
+}
+
+// ParseFile extracts the diagnostics of the build log `fname`
+func (a *LogAnalyzer) ParseFile(fname string) ([]Diagnostic, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	diags, err := a.Parse(f)
+	for i := range diags {
+		diags[i].Log = fname
+	}
+	return diags, err
+}
+
+// Parse extracts the diagnostics of a build log, in log order.
+// Identical diagnostics (e.g. warnings of a header included by several
+// files) are reported once, with their number of occurrences.
+func (a *LogAnalyzer) Parse(r io.Reader) ([]Diagnostic, error) {
+	diags := make([]Diagnostic, 0)
+	seen := make(map[string]int)
+	var ctx logContext
+	var included []Location
+	last := -1   // index of the last error or warning, notes are attached to
+	dup := false // whether the last error or warning was a duplicate
+
+	add := func(d Diagnostic) {
+		d.File = resolve_log_path(d.File, ctx)
+		for i := range d.Included {
+			d.Included[i].File = resolve_log_path(d.Included[i].File, ctx)
+		}
+		d.Package = a.package_of(d.File, ctx)
+		key := fmt.Sprintf("%s|%s|%s:%d:%d|%s", d.Kind, d.Severity, d.File, d.Line, d.Column, d.Message)
+		if i, ok := seen[key]; ok {
+			diags[i].Count++
+			last, dup = i, true
+			return
+		}
+		dup = false
+		d.Count = 1
+		seen[key] = len(diags)
+		last = len(diags)
+		diags = append(diags, d)
+	}
+
+	scan := bufio.NewScanner(r)
+	scan.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for n := 1; scan.Scan(); n++ {
+		line := strings.TrimRight(scan.Text(), " \r")
+
+		if m := re_ctx_driver.FindStringSubmatch(line); m != nil {
+			ctx = logContext{pkg: m[1]}
+			if dir, ok := a.Packages[m[1]]; ok {
+				ctx.dir = filepath.Join(dir, "cmt")
+			}
+			continue
+		}
+		if m := re_ctx_trying.FindStringSubmatch(line); m != nil {
+			ctx = logContext{dir: m[1]}
+			ctx.pkg = a.package_of(m[1], logContext{})
+			continue
+		}
+		if m := re_ctx_entering.FindStringSubmatch(line); m != nil {
+			ctx.dir = m[1]
+			if pkg := a.package_of(m[1], logContext{}); pkg != "" {
+				ctx.pkg = pkg
+			}
+			continue
+		}
+
+		if re_diag_scope.MatchString(line) {
+			// "file.cxx: In function 'f':" and the like
+			continue
+		}
+		if m := re_diag_included.FindStringSubmatch(line); m != nil {
+			included = append(included, Location{File: m[1], Line: atoi(m[2]), Column: atoi(m[3])})
+			continue
+		}
+
+		if m := re_diag_compiler.FindStringSubmatch(line); m != nil {
+			severity := m[4]
+			if severity == "fatal error" {
+				severity = "error"
+			}
+			if severity == "note" && last >= 0 {
+				if dup {
+					continue
+				}
+				diags[last].Notes = append(diags[last].Notes, Location{
+					File: resolve_log_path(m[1], ctx), Line: atoi(m[2]), Column: atoi(m[3]), Message: m[5],
+				})
+				continue
+			}
+			d := Diagnostic{
+				Kind:     "compiler",
+				Rule:     "compiler-" + severity,
+				Severity: severity,
+				File:     m[1],
+				Line:     atoi(m[2]),
+				Column:   atoi(m[3]),
+				Message:  m[5],
+				LogLine:  n,
+			}
+			if w := re_diag_wflag.FindStringSubmatch(d.Message); w != nil {
+				d.Rule = w[1]
+			}
+			d.Included, included = included, nil
+			add(d)
+			continue
+		}
+		included = nil
+
+		if m := re_diag_undefref.FindStringSubmatch(line); m != nil {
+			add(Diagnostic{
+				Kind:     "linker",
+				Rule:     "undefined-reference",
+				Severity: "error",
+				File:     re_diag_ldprefix.ReplaceAllString(m[1], ""),
+				Line:     atoi(m[2]),
+				Message:  "undefined reference to '" + m[3] + "'",
+				LogLine:  n,
+			})
+			continue
+		}
+		if m := re_diag_ld.FindStringSubmatch(line); m != nil {
+			d := Diagnostic{
+				Kind:     "linker",
+				Rule:     "linker",
+				Severity: "error",
+				Message:  m[1],
+				LogLine:  n,
+			}
+			switch {
+			case strings.HasPrefix(m[1], "cannot find -l"):
+				d.Rule = "missing-library"
+			case strings.HasPrefix(m[1], "undefined symbol"):
+				d.Rule = "undefined-reference"
+			case strings.Contains(line, "warning: "):
+				d.Severity = "warning"
+			}
+			add(d)
+			continue
+		}
+		if m := re_diag_cmt.FindStringSubmatch(line); m != nil {
+			d := Diagnostic{
+				Kind:     "cmt",
+				Rule:     "cmt",
+				Severity: "error",
+				Message:  m[2],
+				LogLine:  n,
+			}
+			if m[1] == "Warning" {
+				d.Severity = "warning"
+			}
+			msg := strings.ToLower(m[2])
+			switch {
+			case strings.Contains(msg, "package") && strings.Contains(msg, "not found"):
+				d.Rule = "missing-use"
+			case strings.Contains(msg, "pattern"):
+				d.Rule = "cmt-pattern"
+			}
+			add(d)
+			if r := re_cmt_request.FindStringSubmatch(m[2]); r != nil {
+				// attribute to the package requesting the missing one
+				if pkg := a.resolve_package(r[1]); pkg != "" {
+					diags[last].Package = pkg
+				}
+			}
+			continue
+		}
+	}
+	return diags, scan.Err()
+}
+
+// AnalyzeReport extracts the diagnostics of the logs of the packages of a
+// build report which did not build successfully
+func (a *LogAnalyzer) AnalyzeReport(rep *BuildReport) ([]Diagnostic, error) {
+	diags := make([]Diagnostic, 0)
+	for _, r := range rep.Results {
+		if r.Status != BuildFailed || r.Log == "" {
+			continue
+		}
+		ds, err := a.ParseFile(r.Log)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ds {
+			if ds[i].Package == "" {
+				ds[i].Package = r.Package
+			}
+		}
+		diags = append(diags, ds...)
+	}
+	return diags, nil
+}
+
+// package_of returns the package holding the file `fname`, resolved
+// relatively to the directory of the context if needed, or the package
+// of the context if none does
+func (a *LogAnalyzer) package_of(fname string, ctx logContext) string {
+	if fname != "" {
+		fname = filepath.Clean(resolve_log_path(fname, ctx))
+		best, bestlen := "", 0
+		for name, dir := range a.Packages {
+			dir = filepath.Clean(dir)
+			if (fname == dir || strings.HasPrefix(fname, dir+string(filepath.Separator))) && len(dir) > bestlen {
+				best, bestlen = name, len(dir)
+			}
+		}
+		if best != "" {
+			return best
+		}
+	}
+	return ctx.pkg
+}
+
+// resolve_log_path resolves the path `fname` of a build log relatively to
+// the directory of the context, when known
+func resolve_log_path(fname string, ctx logContext) string {
+	if fname == "" || filepath.IsAbs(fname) || ctx.dir == "" {
+		return fname
+	}
+	return filepath.Join(ctx.dir, fname)
+}
+
+// resolve_package returns the full name of the known package `name`
+// (full name or basename), or ""
+func (a *LogAnalyzer) resolve_package(name string) string {
+	pkgs := make(map[string]Package, len(a.Packages))
+	for full := range a.Packages {
+		pkgs[full] = Package{Name: full}
+	}
+	names, err := resolve_packages(pkgs, []string{name})
+	if err != nil {
+		return ""
+	}
+	return names[0]
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// WriteDiagnosticsJSON writes diagnostics as a JSON array into `w`
+func WriteDiagnosticsJSON(w io.Writer, diags []Diagnostic) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(diags)
+}
+
+// WriteDiagnosticsText writes diagnostics in the usual compiler format into `w`
+func WriteDiagnosticsText(w io.Writer, diags []Diagnostic) error {
+	for _, d := range diags {
+		loc := d.File
+		if d.Line > 0 {
+			loc += ":" + strconv.Itoa(d.Line)
+		}
+		if d.Column > 0 {
+			loc += ":" + strconv.Itoa(d.Column)
+		}
+		if loc == "" {
+			loc = d.Kind
+		}
+		msg := d.Message
+		if !strings.HasSuffix(msg, "["+d.Rule+"]") {
+			msg += " [" + d.Rule + "]"
+		}
+		_, err := fmt.Fprintf(w, "%s: %s: %s (%s", loc, d.Severity, msg, or_dash(d.Package))
+		if err != nil {
+			return err
+		}
+		if d.Count > 1 {
+			fmt.Fprintf(w, ", x%d", d.Count)
+		}
+		fmt.Fprintf(w, ")\n")
+	}
+	return nil
+}
+
+// WriteSARIF writes diagnostics as a SARIF 2.1.0 log into `w`.
+// Files under `basedir` are reported relatively to it (with the
+// "SRCROOT" base identifier), so CI systems can map them to sources.
+func WriteSARIF(w io.Writer, diags []Diagnostic, basedir string) error {
+	type sarifMessage struct {
+		Text string `json:"text"`
+	}
+	type sarifArtifact struct {
+		URI       string `json:"uri"`
+		URIBaseID string `json:"uriBaseId,omitempty"`
+	}
+	type sarifRegion struct {
+		StartLine   int `json:"startLine,omitempty"`
+		StartColumn int `json:"startColumn,omitempty"`
+	}
+	type sarifPhysical struct {
+		Artifact sarifArtifact `json:"artifactLocation"`
+		Region   *sarifRegion  `json:"region,omitempty"`
+	}
+	type sarifLocation struct {
+		Physical sarifPhysical `json:"physicalLocation"`
+		Message  *sarifMessage `json:"message,omitempty"`
+	}
+	type sarifResult struct {
+		RuleID     string                 `json:"ruleId"`
+		Level      string                 `json:"level"`
+		Message    sarifMessage           `json:"message"`
+		Locations  []sarifLocation        `json:"locations,omitempty"`
+		Related    []sarifLocation        `json:"relatedLocations,omitempty"`
+		Properties map[string]interface{} `json:"properties,omitempty"`
+	}
+	type sarifRule struct {
+		ID string `json:"id"`
+	}
+
+	location := func(file string, line, col int, msg string) sarifLocation {
+		art := sarifArtifact{URI: filepath.ToSlash(file)}
+		if basedir != "" && filepath.IsAbs(file) {
+			if rel, err := filepath.Rel(basedir, file); err == nil && !strings.HasPrefix(rel, "..") {
+				art = sarifArtifact{URI: filepath.ToSlash(rel), URIBaseID: "SRCROOT"}
+			}
+		}
+		if art.URIBaseID == "" && filepath.IsAbs(file) {
+			art.URI = "file://" + filepath.ToSlash(file)
+		}
+		loc := sarifLocation{Physical: sarifPhysical{Artifact: art}}
+		if line > 0 {
+			loc.Physical.Region = &sarifRegion{StartLine: line, StartColumn: col}
+		}
+		if msg != "" {
+			loc.Message = &sarifMessage{Text: msg}
+		}
+		return loc
+	}
+
+	rules := make(map[string]bool)
+	results := make([]sarifResult, 0, len(diags))
+	for _, d := range diags {
+		rules[d.Rule] = true
+		res := sarifResult{
+			RuleID:  d.Rule,
+			Level:   d.Severity,
+			Message: sarifMessage{Text: d.Message},
+			Properties: map[string]interface{}{
+				"kind":  d.Kind,
+				"count": d.Count,
+			},
+		}
+		if d.Package != "" {
+			res.Properties["package"] = d.Package
+		}
+		if d.File != "" {
+			res.Locations = append(res.Locations, location(d.File, d.Line, d.Column, ""))
+		}
+		for _, inc := range d.Included {
+			res.Related = append(res.Related, location(inc.File, inc.Line, inc.Column, "included from here"))
+		}
+		for _, note := range d.Notes {
+			res.Related = append(res.Related, location(note.File, note.Line, note.Column, note.Message))
+		}
+		results = append(results, res)
+	}
+
+	ids := make([]string, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	driver := map[string]interface{}{
+		"name":           "go-cmt",
+		"informationUri": "https://github.com/atlas-org/cmt",
+		"rules":          make([]sarifRule, 0, len(ids)),
+	}
+	for _, id := range ids {
+		driver["rules"] = append(driver["rules"].([]sarifRule), sarifRule{ID: id})
+	}
+
+	run := map[string]interface{}{
+		"tool":    map[string]interface{}{"driver": driver},
+		"results": results,
+	}
+	if basedir != "" {
+		run["originalUriBaseIds"] = map[string]interface{}{
+			"SRCROOT": map[string]string{"uri": "file://" + filepath.ToSlash(filepath.Clean(basedir)) + "/"},
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{
+		"version": "2.1.0",
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"runs":    []interface{}{run},
+	})
+}
+
+// EOF
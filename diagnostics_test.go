@@ -0,0 +1,248 @@
+package cmt
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestAnalyzer() *LogAnalyzer {
+	return &LogAnalyzer{Packages: map[string]string{
+		"Control/StoreGate":    "/wa/Control/StoreGate",
+		"Control/AthenaKernel": "/wa/Control/AthenaKernel",
+	}}
+}
+
+func TestLogAnalyzerRules(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		log  string
+		want Diagnostic // Kind, Rule, Severity, File, Line, Column, Message and Package
+	}{
+		{
+			name: "compiler-error",
+			log: "::: [Control/StoreGate] make\n" +
+				"make[2]: Entering directory '/wa/Control/StoreGate/cmt'\n" +
+				"../src/SGImplSvc.cxx:42:7: error: 'foo' was not declared in this scope\n",
+			want: Diagnostic{Kind: "compiler", Rule: "compiler-error", Severity: "error",
+				File: "/wa/Control/StoreGate/src/SGImplSvc.cxx", Line: 42, Column: 7,
+				Message: "'foo' was not declared in this scope", Package: "Control/StoreGate"},
+		},
+		{
+			name: "compiler-fatal",
+			log:  "/wa/Control/AthenaKernel/src/A.cxx:3:10: fatal error: B.h: No such file or directory\n",
+			want: Diagnostic{Kind: "compiler", Rule: "compiler-error", Severity: "error",
+				File: "/wa/Control/AthenaKernel/src/A.cxx", Line: 3, Column: 10,
+				Message: "B.h: No such file or directory", Package: "Control/AthenaKernel"},
+		},
+		{
+			name: "compiler-warning",
+			log:  "/wa/Control/AthenaKernel/AthenaKernel/IProxy.h:10:5: warning: unused variable 'x' [-Wunused-variable]\n",
+			want: Diagnostic{Kind: "compiler", Rule: "-Wunused-variable", Severity: "warning",
+				File: "/wa/Control/AthenaKernel/AthenaKernel/IProxy.h", Line: 10, Column: 5,
+				Message: "unused variable 'x' [-Wunused-variable]", Package: "Control/AthenaKernel"},
+		},
+		{
+			// linker paths are relative to the cmt directory of the package
+			name: "undefined-reference",
+			log: "::: [Control/StoreGate] make\n" +
+				"/usr/bin/ld: SGImplSvc.cxx:(.text+0x12): undefined reference to `baz()'\n",
+			want: Diagnostic{Kind: "linker", Rule: "undefined-reference", Severity: "error",
+				File: "/wa/Control/StoreGate/cmt/SGImplSvc.cxx", Message: "undefined reference to 'baz()'", Package: "Control/StoreGate"},
+		},
+		{
+			name: "missing-library",
+			log: "::: [Control/StoreGate] make\n" +
+				"/usr/bin/ld: cannot find -lMissingLib\n",
+			want: Diagnostic{Kind: "linker", Rule: "missing-library", Severity: "error",
+				Message: "cannot find -lMissingLib", Package: "Control/StoreGate"},
+		},
+		{
+			// attributed to the package requesting the missing one
+			name: "missing-use",
+			log:  "#CMT---> Warning: package AthenaKernel AthenaKernel-* Control not found (requested by StoreGate)\n",
+			want: Diagnostic{Kind: "cmt", Rule: "missing-use", Severity: "warning",
+				Message: "package AthenaKernel AthenaKernel-* Control not found (requested by StoreGate)", Package: "Control/StoreGate"},
+		},
+		{
+			name: "cmt-pattern",
+			log: "# Now trying [cmt make] in /wa/Control/AthenaKernel/cmt (1/2)\n" +
+				"#CMT---> Error: The pattern foo_pattern is not defined\n",
+			want: Diagnostic{Kind: "cmt", Rule: "cmt-pattern", Severity: "error",
+				Message: "The pattern foo_pattern is not defined", Package: "Control/AthenaKernel"},
+		},
+	} {
+		diags, err := newTestAnalyzer().Parse(strings.NewReader(tc.log))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(diags) != 1 {
+			t.Errorf("%s: got %d diagnostics, want 1: %+v", tc.name, len(diags), diags)
+			continue
+		}
+		d := diags[0]
+		got := Diagnostic{Kind: d.Kind, Rule: d.Rule, Severity: d.Severity,
+			File: d.File, Line: d.Line, Column: d.Column,
+			Message: d.Message, Package: d.Package}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\ngot:  %+v\nwant: %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+const testBuildLog = `::: [Control/StoreGate] make
+make[2]: Entering directory '/wa/Control/StoreGate/cmt'
+In file included from /wa/Control/AthenaKernel/AthenaKernel/IProxy.h:3,
+                 from ../src/SGImplSvc.cxx:12:
+/wa/Control/AthenaKernel/AthenaKernel/IProxy.h: In member function 'void f()':
+/wa/Control/AthenaKernel/AthenaKernel/IProxy.h:10:5: warning: unused variable 'x' [-Wunused-variable]
+../src/SGImplSvc.cxx:42:7: error: 'foo' was not declared in this scope
+../src/SGImplSvc.cxx:30:3: note: suggested alternative: 'fooo'
+In file included from /wa/Control/AthenaKernel/AthenaKernel/IProxy.h:3,
+                 from ../src/Other.cxx:1:
+/wa/Control/AthenaKernel/AthenaKernel/IProxy.h:10:5: warning: unused variable 'x' [-Wunused-variable]
+collect2: error: ld returned 1 exit status
+`
+
+func TestLogAnalyzerContext(t *testing.T) {
+	diags, err := newTestAnalyzer().Parse(strings.NewReader(testBuildLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diags) != 2 {
+		t.Fatalf("got %d diagnostics, want 2: %+v", len(diags), diags)
+	}
+
+	// the warning of the header is reported once, with its include chain
+	w := diags[0]
+	if w.Count != 2 || w.LogLine != 6 {
+		t.Errorf("warning: got count=%d log_line=%d, want 2 and 6", w.Count, w.LogLine)
+	}
+	included := []Location{
+		{File: "/wa/Control/AthenaKernel/AthenaKernel/IProxy.h", Line: 3},
+		{File: "/wa/Control/StoreGate/src/SGImplSvc.cxx", Line: 12},
+	}
+	if !reflect.DeepEqual(w.Included, included) {
+		t.Errorf("warning: got include chain %+v, want %+v", w.Included, included)
+	}
+
+	// notes are attached to the error they follow
+	e := diags[1]
+	notes := []Location{{File: "/wa/Control/StoreGate/src/SGImplSvc.cxx", Line: 30, Column: 3, Message: "suggested alternative: 'fooo'"}}
+	if !reflect.DeepEqual(e.Notes, notes) {
+		t.Errorf("error: got notes %+v, want %+v", e.Notes, notes)
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	diags, err := newTestAnalyzer().Parse(strings.NewReader(testBuildLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	err = WriteSARIF(buf, diags, "/wa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []struct {
+				RuleID    string `json:"ruleId"`
+				Level     string `json:"level"`
+				Locations []struct {
+					Physical struct {
+						Artifact struct {
+							URI       string `json:"uri"`
+							URIBaseID string `json:"uriBaseId"`
+						} `json:"artifactLocation"`
+						Region struct {
+							StartLine   int `json:"startLine"`
+							StartColumn int `json:"startColumn"`
+						} `json:"region"`
+					} `json:"physicalLocation"`
+				} `json:"locations"`
+				Related    []json.RawMessage      `json:"relatedLocations"`
+				Properties map[string]interface{} `json:"properties"`
+			} `json:"results"`
+			BaseIDs map[string]struct {
+				URI string `json:"uri"`
+			} `json:"originalUriBaseIds"`
+		} `json:"runs"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &doc)
+	if err != nil {
+		t.Fatalf("invalid SARIF: %v\n%s", err, buf)
+	}
+	if doc.Version != "2.1.0" || len(doc.Runs) != 1 {
+		t.Fatalf("got version %q with %d runs", doc.Version, len(doc.Runs))
+	}
+	run := doc.Runs[0]
+	if got := run.BaseIDs["SRCROOT"].URI; got != "file:///wa/" {
+		t.Errorf("got SRCROOT %q, want file:///wa/", got)
+	}
+	rules := make([]string, 0)
+	for _, r := range run.Tool.Driver.Rules {
+		rules = append(rules, r.ID)
+	}
+	if want := []string{"-Wunused-variable", "compiler-error"}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("got rules %v, want %v", rules, want)
+	}
+	if len(run.Results) != 2 {
+		t.Fatalf("got %d results, want 2", len(run.Results))
+	}
+	for i, tc := range []struct {
+		rule, level, uri string
+		line, column     int
+		related          int
+		pkg              string
+	}{
+		{"-Wunused-variable", "warning", "Control/AthenaKernel/AthenaKernel/IProxy.h", 10, 5, 2, "Control/AthenaKernel"},
+		{"compiler-error", "error", "Control/StoreGate/src/SGImplSvc.cxx", 42, 7, 1, "Control/StoreGate"},
+	} {
+		res := run.Results[i]
+		if res.RuleID != tc.rule || res.Level != tc.level {
+			t.Errorf("result #%d: got %s/%s, want %s/%s", i, res.RuleID, res.Level, tc.rule, tc.level)
+		}
+		if len(res.Locations) != 1 {
+			t.Errorf("result #%d: got %d locations, want 1", i, len(res.Locations))
+			continue
+		}
+		loc := res.Locations[0].Physical
+		if loc.Artifact.URI != tc.uri || loc.Artifact.URIBaseID != "SRCROOT" {
+			t.Errorf("result #%d: got uri %s (%s), want %s (SRCROOT)", i, loc.Artifact.URI, loc.Artifact.URIBaseID, tc.uri)
+		}
+		if loc.Region.StartLine != tc.line || loc.Region.StartColumn != tc.column {
+			t.Errorf("result #%d: got %d:%d, want %d:%d", i, loc.Region.StartLine, loc.Region.StartColumn, tc.line, tc.column)
+		}
+		if len(res.Related) != tc.related {
+			t.Errorf("result #%d: got %d related locations, want %d", i, len(res.Related), tc.related)
+		}
+		if res.Properties["package"] != tc.pkg {
+			t.Errorf("result #%d: got package %v, want %s", i, res.Properties["package"], tc.pkg)
+		}
+	}
+
+	// files outside the base directory keep their absolute URI
+	buf.Reset()
+	err = WriteSARIF(buf, []Diagnostic{{Kind: "compiler", Rule: "compiler-error", Severity: "error", File: "/usr/include/x.h", Line: 1}}, "/wa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"uri": "file:///usr/include/x.h"`) {
+		t.Errorf("absolute URI not kept:\n%s", buf)
+	}
+}
+
+// EOF
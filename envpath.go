@@ -0,0 +1,229 @@
+package cmt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PathList returns the entries of the colon-separated environment
+// variable `name` (e.g. PATH, LD_LIBRARY_PATH, PYTHONPATH, JOBOPTSEARCHPATH)
+// as seen by the setup's subshell. Empty entries are dropped.
+func (s *Setup) PathList(name string) []string {
+	return split_path_list(s.sh.Getenv(name))
+}
+
+// SetPathList replaces the content of the environment variable `name`
+// with `entries`, in the setup's subshell.
+func (s *Setup) SetPathList(name string, entries []string) error {
+	return s.Setenv(name, strings.Join(entries, string(os.PathListSeparator)))
+}
+
+// PrependPath adds `entries` at the front of the path-list variable `name`.
+// Entries already present are moved to the front.
+func (s *Setup) PrependPath(name string, entries ...string) error {
+	list := remove_entries(s.PathList(name), entries)
+	return s.SetPathList(name, append(append([]string{}, entries...), list...))
+}
+
+// AppendPath adds `entries` at the end of the path-list variable `name`.
+// Entries already present are moved to the end.
+func (s *Setup) AppendPath(name string, entries ...string) error {
+	list := remove_entries(s.PathList(name), entries)
+	return s.SetPathList(name, append(list, entries...))
+}
+
+// RemovePath removes all occurrences of `entries` from the path-list
+// variable `name`.
+func (s *Setup) RemovePath(name string, entries ...string) error {
+	return s.SetPathList(name, remove_entries(s.PathList(name), entries))
+}
+
+// DedupPath removes duplicate entries from the path-list variable `name`,
+// keeping the first occurrence of each entry.
+func (s *Setup) DedupPath(name string) error {
+	list := s.PathList(name)
+	seen := make(map[string]bool, len(list))
+	out := make([]string, 0, len(list))
+	for _, entry := range list {
+		key := filepath.Clean(entry)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out = append(out, entry)
+	}
+	return s.SetPathList(name, out)
+}
+
+// DuplicatePaths returns the entries of the path-list variable `name`
+// which appear more than once.
+func (s *Setup) DuplicatePaths(name string) []string {
+	count := make(map[string]int)
+	dups := make([]string, 0)
+	for _, entry := range s.PathList(name) {
+		key := filepath.Clean(entry)
+		count[key]++
+		if count[key] == 2 {
+			dups = append(dups, entry)
+		}
+	}
+	return dups
+}
+
+// FindInPath returns the first entry of the path-list variable `name`
+// which provides the file `fname`.
+// `fname` may be a relative path, e.g. "AthExHelloWorld/HelloWorldOptions.py"
+// for JOBOPTSEARCHPATH.
+func (s *Setup) FindInPath(name, fname string) (string, error) {
+	entries := s.FindAllInPath(name, fname)
+	if len(entries) <= 0 {
+		return "", fmt.Errorf("cmt: [%s] not found in $%s", fname, name)
+	}
+	return entries[0], nil
+}
+
+// FindAllInPath returns all the entries of the path-list variable `name`
+// which provide the file `fname`, in resolution order.
+// All but the first one are shadowed.
+func (s *Setup) FindAllInPath(name, fname string) []string {
+	entries := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	for _, entry := range s.PathList(name) {
+		key := filepath.Clean(entry)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if path_exists(filepath.Join(entry, fname)) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// FindLibrary returns the LD_LIBRARY_PATH entry providing the library `lib`.
+// `lib` may be given as "Foo", "libFoo" or "libFoo.so".
+func (s *Setup) FindLibrary(lib string) (string, error) {
+	if !strings.HasPrefix(lib, "lib") {
+		lib = "lib" + lib
+	}
+	if !strings.Contains(lib, ".so") {
+		lib = lib + ".so"
+	}
+	return s.FindInPath("LD_LIBRARY_PATH", lib)
+}
+
+// FindPythonModule returns the PYTHONPATH entry providing the python
+// module or package `mod` (e.g. "AthenaCommon.Include").
+func (s *Setup) FindPythonModule(mod string) (string, error) {
+	base := filepath.Join(strings.Split(mod, ".")...)
+	for _, entry := range s.PathList("PYTHONPATH") {
+		for _, fname := range []string{
+			base + ".py",
+			base + ".pyc",
+			base + ".so",
+			filepath.Join(base, "__init__.py"),
+		} {
+			if path_exists(filepath.Join(entry, fname)) {
+				return entry, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cmt: python module [%s] not found in $PYTHONPATH", mod)
+}
+
+// FindJobOptions returns the JOBOPTSEARCHPATH entry providing the
+// jobOptions file `fname`.
+func (s *Setup) FindJobOptions(fname string) (string, error) {
+	return s.FindInPath("JOBOPTSEARCHPATH", fname)
+}
+
+// PathShadow describes a file provided by more than one entry of
+// a path-list variable.
+type PathShadow struct {
+	File     string   // name of the file, relative to the path entries
+	Entry    string   // path entry providing the file
+	Shadowed []string // path entries providing the same file, hidden by Entry
+}
+
+// ShadowedFiles returns the files provided by more than one entry of the
+// path-list variable `name`, sorted by file name.
+// Only the top-level content of each entry is inspected.
+func (s *Setup) ShadowedFiles(name string) ([]PathShadow, error) {
+	idx := make(map[string]int)
+	shadows := make([]PathShadow, 0)
+	seen := make(map[string]bool)
+	for _, entry := range s.PathList(name) {
+		key := filepath.Clean(entry)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		files, err := ioutil.ReadDir(entry)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range files {
+			fname := fi.Name()
+			i, ok := idx[fname]
+			if !ok {
+				idx[fname] = len(shadows)
+				shadows = append(shadows, PathShadow{File: fname, Entry: entry})
+				continue
+			}
+			shadows[i].Shadowed = append(shadows[i].Shadowed, entry)
+		}
+	}
+
+	out := make([]PathShadow, 0)
+	for _, shadow := range shadows {
+		if len(shadow.Shadowed) > 0 {
+			out = append(out, shadow)
+		}
+	}
+	sort.Sort(pathShadows(out))
+	return out, nil
+}
+
+type pathShadows []PathShadow
+
+func (p pathShadows) Len() int           { return len(p) }
+func (p pathShadows) Less(i, j int) bool { return p[i].File < p[j].File }
+func (p pathShadows) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// split_path_list splits a colon-separated list, dropping empty entries
+func split_path_list(v string) []string {
+	list := make([]string, 0)
+	for _, entry := range filepath.SplitList(v) {
+		if entry == "" {
+			continue
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// remove_entries returns list without any of the entries in rm
+func remove_entries(list, rm []string) []string {
+	drop := make(map[string]bool, len(rm))
+	for _, entry := range rm {
+		drop[filepath.Clean(entry)] = true
+	}
+	out := make([]string, 0, len(list))
+	for _, entry := range list {
+		if drop[filepath.Clean(entry)] {
+			continue
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+// EOF
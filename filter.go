@@ -0,0 +1,145 @@
+package cmt
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// TagDiffFilter selects the packages of tag differences and tag matrices.
+// Empty criteria select everything.
+type TagDiffFilter struct {
+	Projects        []string       // keep only packages of these projects
+	ExcludeProjects []string       // drop packages of these projects
+	Packages        []string       // glob patterns on package full names (e.g. "Tracking/*")
+	Regexp          *regexp.Regexp // regular expression on package full names
+	Kinds           []ChangeKind   // kinds of changes to keep
+	NoExternals     bool           // drop externals (External/*, LCG_Interfaces/*) and policy packages
+}
+
+// MatchPackage returns whether the package `p` passes all the criteria
+// of the filter but the kind of change
+func (f *TagDiffFilter) MatchPackage(p Package) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Projects) > 0 && !has_project_name(f.Projects, p.Project) {
+		return false
+	}
+	if has_project_name(f.ExcludeProjects, p.Project) {
+		return false
+	}
+	if len(f.Packages) > 0 && !match_globs(f.Packages, p.Name) {
+		return false
+	}
+	if f.Regexp != nil && !f.Regexp.MatchString(p.Name) {
+		return false
+	}
+	if f.NoExternals && is_external(p) {
+		return false
+	}
+	return true
+}
+
+// Match returns whether the entry `e` passes all the criteria of the filter
+func (f *TagDiffFilter) Match(e TagDiffEntry) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Kinds) > 0 && !has_kind(f.Kinds, e.Kind) {
+		return false
+	}
+	pkg := e.New
+	if e.Kind == Removed {
+		pkg = e.Old
+	}
+	if f.MatchPackage(pkg) {
+		return true
+	}
+	// packages moving in or out of a selected project are selected too
+	return e.Kind == Moved && f.MatchPackage(e.Old)
+}
+
+// Filter returns the tag differences selected by `f`
+func (r *TagDiffResult) Filter(f *TagDiffFilter) *TagDiffResult {
+	out := *r
+	out.Entries = make([]TagDiffEntry, 0, len(r.Entries))
+	for _, e := range r.Entries {
+		if f.Match(e) {
+			out.Entries = append(out.Entries, e)
+		}
+	}
+	return &out
+}
+
+// Filter returns the rows of the tag matrix selected by `f`.
+// Kinds of changes are ignored.
+func (m *TagMatrix) Filter(f *TagDiffFilter) *TagMatrix {
+	out := *m
+	out.Rows = make([]TagMatrixRow, 0, len(m.Rows))
+	for _, row := range m.Rows {
+		for _, pkg := range row.Packages {
+			if pkg.Name != "" && f.MatchPackage(pkg) {
+				out.Rows = append(out.Rows, row)
+				break
+			}
+		}
+	}
+	return &out
+}
+
+// ParseChangeKind returns the kind of change named `name`
+// (as returned by ChangeKind.String)
+func ParseChangeKind(name string) (ChangeKind, error) {
+	for _, k := range ChangeKinds {
+		if k.String() == name {
+			return k, nil
+		}
+	}
+	return Unchanged, fmt.Errorf("cmt: unknown kind of change [%s]", name)
+}
+
+// has_project_name returns whether `proj` is in `names`, with or without
+// the "Atlas" prefix
+func has_project_name(names []string, proj string) bool {
+	proj = short_project_name(proj)
+	for _, name := range names {
+		if short_project_name(name) == proj {
+			return true
+		}
+	}
+	return false
+}
+
+// match_globs returns whether the package `name`, or one of its parent
+// directories, matches one of the glob patterns
+func match_globs(patterns []string, name string) bool {
+	for _, pat := range patterns {
+		for dir := name; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			ok, err := path.Match(pat, dir)
+			if err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func has_kind(kinds []ChangeKind, k ChangeKind) bool {
+	for _, kk := range kinds {
+		if kk == k {
+			return true
+		}
+	}
+	return false
+}
+
+// is_external returns whether `p` is an external or a policy package
+func is_external(p Package) bool {
+	return strings.HasPrefix(p.Name, "External/") ||
+		strings.HasPrefix(p.Name, "LCG_Interfaces/") ||
+		strings.HasSuffix(p.Base(), "Policy")
+}
+
+// EOF
@@ -0,0 +1,165 @@
+package cmt
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestTagDiffFilterMatchPackage(t *testing.T) {
+	sg := Package{"Control/StoreGate", "StoreGate-02-00-00", "AtlasCore"}
+	trk := Package{"Tracking/TrkEvent/TrkTrack", "TrkTrack-01-00-00", "AtlasReconstruction"}
+	ext := Package{"External/AtlasBoost", "AtlasBoost-00-01-00", "AtlasExternals"}
+	policy := Package{"AtlasPolicy", "AtlasPolicy-01-00-00", "AtlasCore"}
+
+	for _, tc := range []struct {
+		name string
+		f    *TagDiffFilter
+		pkg  Package
+		want bool
+	}{
+		{"nil", nil, sg, true},
+		{"empty", &TagDiffFilter{}, sg, true},
+		{"project", &TagDiffFilter{Projects: []string{"AtlasCore"}}, sg, true},
+		{"project-short", &TagDiffFilter{Projects: []string{"Core"}}, sg, true},
+		{"project-other", &TagDiffFilter{Projects: []string{"Reconstruction"}}, sg, false},
+		{"exclude-project", &TagDiffFilter{ExcludeProjects: []string{"Core"}}, sg, false},
+		{"exclude-other", &TagDiffFilter{ExcludeProjects: []string{"AtlasEvent"}}, sg, true},
+		{"glob", &TagDiffFilter{Packages: []string{"Control/*"}}, sg, true},
+		{"glob-parent", &TagDiffFilter{Packages: []string{"Tracking/*"}}, trk, true},
+		{"glob-full", &TagDiffFilter{Packages: []string{"Tracking/TrkEvent/TrkTrack"}}, trk, true},
+		{"glob-other", &TagDiffFilter{Packages: []string{"Tracking/*"}}, sg, false},
+		{"glob-partial", &TagDiffFilter{Packages: []string{"Control/Store"}}, sg, false},
+		{"regexp", &TagDiffFilter{Regexp: regexp.MustCompile("Store")}, sg, true},
+		{"regexp-other", &TagDiffFilter{Regexp: regexp.MustCompile("^Trk")}, trk, false},
+		{"no-externals", &TagDiffFilter{NoExternals: true}, ext, false},
+		{"no-externals-policy", &TagDiffFilter{NoExternals: true}, policy, false},
+		{"no-externals-pkg", &TagDiffFilter{NoExternals: true}, sg, true},
+		{"all", &TagDiffFilter{
+			Projects: []string{"Reconstruction"},
+			Packages: []string{"Tracking/*"},
+			Regexp:   regexp.MustCompile("Track$"),
+		}, trk, true},
+		{"all-but-one", &TagDiffFilter{
+			Projects: []string{"Reconstruction"},
+			Packages: []string{"Tracking/*"},
+			Regexp:   regexp.MustCompile("Event$"),
+		}, trk, false},
+	} {
+		got := tc.f.MatchPackage(tc.pkg)
+		if got != tc.want {
+			t.Errorf("%s: MatchPackage(%s) = %v, want %v", tc.name, tc.pkg.Name, got, tc.want)
+		}
+	}
+}
+
+func TestTagDiffFilterMatch(t *testing.T) {
+	old := Package{"Control/StoreGate", "StoreGate-02-00-00", "AtlasCore"}
+	cur := Package{"Control/StoreGate", "StoreGate-02-00-01", "AtlasCore"}
+	moved := Package{"Control/StoreGate", "StoreGate-02-00-01", "AtlasEvent"}
+
+	changed := TagDiffEntry{Name: old.Name, Kind: VersionChanged, Old: old, New: cur}
+	added := TagDiffEntry{Name: old.Name, Kind: Added, New: cur}
+	removed := TagDiffEntry{Name: old.Name, Kind: Removed, Old: old}
+	move := TagDiffEntry{Name: old.Name, Kind: Moved, Old: old, New: moved}
+
+	for _, tc := range []struct {
+		name string
+		f    *TagDiffFilter
+		e    TagDiffEntry
+		want bool
+	}{
+		{"nil", nil, changed, true},
+		{"kind", &TagDiffFilter{Kinds: []ChangeKind{VersionChanged}}, changed, true},
+		{"kind-other", &TagDiffFilter{Kinds: []ChangeKind{Added, Removed}}, changed, false},
+		{"added", &TagDiffFilter{Projects: []string{"Core"}}, added, true},
+		{"removed", &TagDiffFilter{Projects: []string{"Core"}}, removed, true},
+		{"removed-other", &TagDiffFilter{Projects: []string{"Event"}}, removed, false},
+		{"moved-in", &TagDiffFilter{Projects: []string{"Event"}}, move, true},
+		{"moved-out", &TagDiffFilter{Projects: []string{"Core"}}, move, true},
+		{"moved-elsewhere", &TagDiffFilter{Projects: []string{"Reconstruction"}}, move, false},
+		{"moved-kind", &TagDiffFilter{Kinds: []ChangeKind{VersionChanged}}, move, false},
+	} {
+		got := tc.f.Match(tc.e)
+		if got != tc.want {
+			t.Errorf("%s: Match(%s %s) = %v, want %v", tc.name, tc.e.Name, tc.e.Kind, got, tc.want)
+		}
+	}
+}
+
+func TestTagDiffFilterResult(t *testing.T) {
+	r := &TagDiffResult{
+		Old: "rel_1",
+		New: "rel_2",
+		Entries: []TagDiffEntry{
+			{Name: "Control/StoreGate", Kind: VersionChanged,
+				Old: Package{"Control/StoreGate", "StoreGate-02-00-00", "AtlasCore"},
+				New: Package{"Control/StoreGate", "StoreGate-02-00-01", "AtlasCore"}},
+			{Name: "External/AtlasBoost", Kind: Added,
+				New: Package{"External/AtlasBoost", "AtlasBoost-00-01-00", "AtlasExternals"}},
+			{Name: "Tracking/TrkEvent", Kind: Removed,
+				Old: Package{"Tracking/TrkEvent", "TrkEvent-00-10-00", "AtlasReconstruction"}},
+		},
+	}
+	out := r.Filter(&TagDiffFilter{NoExternals: true})
+	if len(out.Entries) != 2 || out.Entries[0].Name != "Control/StoreGate" || out.Entries[1].Name != "Tracking/TrkEvent" {
+		t.Fatalf("got %+v", out.Entries)
+	}
+	if out.Old != r.Old || out.New != r.New {
+		t.Fatalf("releases not kept: %s -> %s", out.Old, out.New)
+	}
+	if len(r.Entries) != 3 {
+		t.Fatalf("input modified: %d entries", len(r.Entries))
+	}
+}
+
+func TestTagDiffFilterMatrix(t *testing.T) {
+	m := &TagMatrix{
+		Releases: []string{"rel_1", "rel_2"},
+		Rows: []TagMatrixRow{
+			{Name: "Control/StoreGate", Project: "AtlasCore", Packages: []Package{
+				{"Control/StoreGate", "StoreGate-02-00-00", "AtlasCore"},
+				{"Control/StoreGate", "StoreGate-02-00-01", "AtlasCore"},
+			}},
+			{Name: "Tracking/TrkEvent", Project: "AtlasReconstruction", Packages: []Package{
+				{},
+				{"Tracking/TrkEvent", "TrkEvent-00-10-00", "AtlasReconstruction"},
+			}},
+		},
+	}
+	for _, tc := range []struct {
+		name string
+		f    *TagDiffFilter
+		want []string
+	}{
+		{"nil", nil, []string{"Control/StoreGate", "Tracking/TrkEvent"}},
+		{"project", &TagDiffFilter{Projects: []string{"Reconstruction"}}, []string{"Tracking/TrkEvent"}},
+		{"glob", &TagDiffFilter{Packages: []string{"Control/*"}}, []string{"Control/StoreGate"}},
+		{"kinds-ignored", &TagDiffFilter{Kinds: []ChangeKind{Removed}}, []string{"Control/StoreGate", "Tracking/TrkEvent"}},
+	} {
+		out := m.Filter(tc.f)
+		if len(out.Rows) != len(tc.want) {
+			t.Errorf("%s: got %d rows, want %d", tc.name, len(out.Rows), len(tc.want))
+			continue
+		}
+		for i, name := range tc.want {
+			if out.Rows[i].Name != name {
+				t.Errorf("%s: row #%d: got %s, want %s", tc.name, i, out.Rows[i].Name, name)
+			}
+		}
+	}
+}
+
+func TestParseChangeKind(t *testing.T) {
+	for _, k := range ChangeKinds {
+		got, err := ParseChangeKind(k.String())
+		if err != nil || got != k {
+			t.Errorf("ParseChangeKind(%q) = %v, %v", k.String(), got, err)
+		}
+	}
+	_, err := ParseChangeKind("renamed")
+	if err == nil {
+		t.Errorf("expected an error for an unknown kind")
+	}
+}
+
+// EOF
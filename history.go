@@ -0,0 +1,238 @@
+package cmt
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryRelease is a release indexed by a TagHistory
+type HistoryRelease struct {
+	Release string    // release identifier, as recorded in the manifest
+	Branch  string    // nightly branch (e.g. "devval"), if any
+	Nightly string    // nightly identifier (e.g. "rel_3"), if any
+	Date    time.Time // date the manifest was captured
+	File    string    // manifest file the release was read from (if any)
+
+	manifest *Manifest
+	pkgs     map[string]Package
+}
+
+// TagSpan describes the presence of a tag of a package in a series of releases
+type TagSpan struct {
+	Tag       string    // package tag (version)
+	Project   string    // project the package was in
+	FirstSeen time.Time // date of the first release holding that tag
+	LastSeen  time.Time // date of the last release holding that tag
+	Releases  []string  // releases holding that tag, in chronological order
+}
+
+// TagChange describes a change of tag of a package between two consecutive releases
+type TagChange struct {
+	Release string    // release where the change appeared
+	Date    time.Time // date of that release
+	Old     Package   // package in the previous release (zero if added)
+	New     Package   // package in that release (zero if removed)
+}
+
+// TagHistory is an index over a collection of release manifests
+// (e.g. archived nightlies), answering questions about the evolution
+// of package tags.
+type TagHistory struct {
+	Releases []*HistoryRelease // indexed releases, in chronological order
+}
+
+// NewTagHistory indexes all the manifest files (*.json) found under `dir`
+func NewTagHistory(dir string) (*TagHistory, error) {
+	h := &TagHistory{Releases: make([]*HistoryRelease, 0)}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		m, err := LoadManifest(path)
+		if err != nil {
+			return err
+		}
+		h.add(m, path)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.sort()
+	return h, nil
+}
+
+// Add indexes the manifest `m`
+func (h *TagHistory) Add(m *Manifest) {
+	h.add(m, "")
+	h.sort()
+}
+
+func (h *TagHistory) add(m *Manifest, fname string) {
+	h.Releases = append(h.Releases, &HistoryRelease{
+		Release:  m.Release,
+		Branch:   release_branch(m.Release),
+		Nightly:  release_nightly(m.Release),
+		Date:     m.Created,
+		File:     fname,
+		manifest: m,
+		pkgs:     m.Packages(),
+	})
+}
+
+func (h *TagHistory) sort() {
+	sort.Stable(historyReleases(h.Releases))
+}
+
+// Branches returns the names of the nightly branches in the history
+func (h *TagHistory) Branches() []string {
+	set := make(map[string]struct{})
+	for _, rel := range h.Releases {
+		if rel.Branch != "" {
+			set[rel.Branch] = struct{}{}
+		}
+	}
+	branches := make([]string, 0, len(set))
+	for b := range set {
+		branches = append(branches, b)
+	}
+	sort.Strings(branches)
+	return branches
+}
+
+// Select returns the releases of branch `branch` (all branches if empty)
+// captured in the [from, to] date range, in chronological order.
+// A zero `from` or `to` leaves that side of the range open.
+func (h *TagHistory) Select(branch string, from, to time.Time) []*HistoryRelease {
+	out := make([]*HistoryRelease, 0)
+	for _, rel := range h.Releases {
+		if branch != "" && rel.Branch != branch {
+			continue
+		}
+		if !from.IsZero() && rel.Date.Before(from) {
+			continue
+		}
+		if !to.IsZero() && rel.Date.After(to) {
+			continue
+		}
+		out = append(out, rel)
+	}
+	return out
+}
+
+// Timeline returns, for each tag the package `pkg` had in the releases of
+// branch `branch` (all branches if empty), when it was first and last seen
+// and in which releases it was present, ordered by first appearance.
+func (h *TagHistory) Timeline(pkg, branch string) []TagSpan {
+	spans := make([]TagSpan, 0)
+	idx := make(map[string]int)
+	for _, rel := range h.Select(branch, time.Time{}, time.Time{}) {
+		p, ok := rel.pkgs[pkg]
+		if !ok {
+			continue
+		}
+		i, ok := idx[p.Version]
+		if !ok {
+			i = len(spans)
+			idx[p.Version] = i
+			spans = append(spans, TagSpan{
+				Tag:       p.Version,
+				Project:   p.Project,
+				FirstSeen: rel.Date,
+			})
+		}
+		spans[i].LastSeen = rel.Date
+		spans[i].Releases = append(spans[i].Releases, rel.Release)
+	}
+	return spans
+}
+
+// PackageChanges returns the changes of tag of the package `pkg` between
+// consecutive releases of branch `branch` (all branches if empty)
+func (h *TagHistory) PackageChanges(pkg, branch string) []TagChange {
+	changes := make([]TagChange, 0)
+	var prev *HistoryRelease
+	for _, rel := range h.Select(branch, time.Time{}, time.Time{}) {
+		if prev != nil {
+			p_old := prev.pkgs[pkg]
+			p_new := rel.pkgs[pkg]
+			if p_old != p_new {
+				changes = append(changes, TagChange{
+					Release: rel.Release,
+					Date:    rel.Date,
+					Old:     p_old,
+					New:     p_new,
+				})
+			}
+		}
+		prev = rel
+	}
+	return changes
+}
+
+// ChangedBetween returns the tag differences between the first and the last
+// releases of branch `branch` (all branches if empty) captured in the
+// [from, to] date range, or nil if there are less than two such releases.
+func (h *TagHistory) ChangedBetween(branch string, from, to time.Time, opts TagDiffOptions) *TagDiffResult {
+	rels := h.Select(branch, from, to)
+	if len(rels) < 2 {
+		return nil
+	}
+	return DiffManifests(rels[0].manifest, rels[len(rels)-1].manifest, opts)
+}
+
+type historyReleases []*HistoryRelease
+
+func (p historyReleases) Len() int           { return len(p) }
+func (p historyReleases) Less(i, j int) bool { return p[i].Date.Before(p[j].Date) }
+func (p historyReleases) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+var (
+	re_nightly = regexp.MustCompile(`^rel_(\d+|latest)$`)
+	re_release = regexp.MustCompile(`^\d+(\.\d+)+$`)
+)
+
+// asetup_options are asetup tags which select neither a release nor a branch
+var asetup_options = map[string]bool{
+	"32": true, "64": true, "opt": true, "dbg": true,
+	"here": true, "builds": true, "runtime": true, "latest": true,
+	"slc5": true, "slc6": true, "gcc43": true, "gcc46": true, "gcc47": true, "gcc48": true,
+}
+
+// release_nightly returns the nightly identifier (rel_N) of asetup tags
+func release_nightly(tags string) string {
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if re_nightly.MatchString(tag) {
+			return tag
+		}
+	}
+	return ""
+}
+
+// release_branch returns the nightly branch selected by asetup tags
+func release_branch(tags string) string {
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "":
+		case re_nightly.MatchString(tag):
+		case re_release.MatchString(tag):
+		case asetup_options[tag]:
+		case strings.HasPrefix(tag, "Atlas"):
+			// project name
+		default:
+			return tag
+		}
+	}
+	return ""
+}
+
+// EOF
@@ -0,0 +1,231 @@
+package cmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Manifest describes the content of a release: its stack of projects and,
+// for each project, the packages (and their tags) declared in the
+// project's *Release/cmt/requirements file.
+//
+// Manifests can be captured from a live environment, saved to disk and
+// diffed later on without any environment.
+type Manifest struct {
+	Release  string            `json:"release"`  // release identifier (e.g. asetup tags)
+	Platform string            `json:"platform"` // platform of the release (e.g. $CMTCONFIG)
+	Created  time.Time         `json:"created"`  // when the manifest was captured
+	Projects []ManifestProject `json:"projects"` // projects, in dependency order
+}
+
+// ManifestProject is a project of a release manifest
+type ManifestProject struct {
+	ReleaseProject
+	Packages []Package `json:"packages"` // packages declared by the project
+}
+
+// Manifest captures the manifest of the release configured in this
+// environment. `release` is recorded as the release identifier.
+func (cmt *Cmt) Manifest(release string) (*Manifest, error) {
+	dag, err := cmt.ProjectsDag()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Release:  release,
+		Platform: cmt.env.Getenv("CMTCONFIG"),
+		Created:  time.Now().UTC(),
+		Projects: make([]ManifestProject, 0, len(dag)),
+	}
+
+	for _, proj := range dag {
+		mp := ManifestProject{
+			ReleaseProject: ReleaseProject{
+				Name:    proj.Name,
+				Version: proj.Version,
+				Path:    proj.Path,
+			},
+			Packages: make([]Package, 0),
+		}
+		dirnames, err := filepath.Glob(filepath.Join(proj.Path, "*Release"))
+		if err != nil {
+			return nil, err
+		}
+		if len(dirnames) == 1 {
+			reldata := filepath.Join(dirnames[0], "cmt", "requirements")
+			uses, err := extract_uses(reldata, cmt.msg)
+			if err != nil {
+				return nil, err
+			}
+			projname := short_project_name(proj.Name)
+			for _, use := range uses {
+				use.Project = projname
+				mp.Packages = append(mp.Packages, use)
+			}
+		}
+		m.Projects = append(m.Projects, mp)
+	}
+	return m, nil
+}
+
+// ReleaseProjects returns the projects of the release
+func (m *Manifest) ReleaseProjects() []ReleaseProject {
+	projs := make([]ReleaseProject, 0, len(m.Projects))
+	for _, p := range m.Projects {
+		projs = append(projs, p.ReleaseProject)
+	}
+	return projs
+}
+
+// Packages returns all the packages of the release, indexed by full name.
+// A package declared by several projects is attributed to the last one.
+func (m *Manifest) Packages() map[string]Package {
+	pkgs := make(map[string]Package)
+	for _, p := range m.Projects {
+		for _, pkg := range p.Packages {
+			pkgs[pkg.Name] = pkg
+		}
+	}
+	return pkgs
+}
+
+// Write encodes the manifest as JSON into `w`
+func (m *Manifest) Write(w io.Writer) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Save writes the manifest into the file `fname`
+func (m *Manifest) Save(fname string) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = m.Write(f)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// ReadManifest decodes a JSON-encoded manifest from `r`
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	err := json.NewDecoder(r).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// LoadManifest reads the manifest stored in the file `fname`
+func LoadManifest(fname string) (*Manifest, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m, err := ReadManifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("cmt: invalid manifest [%s]: %v", fname, err)
+	}
+	return m, nil
+}
+
+// LoadRelease returns the manifest of the release `spec`: either the path
+// to a manifest file, or asetup tags, in which case the environment is set
+// up to capture the manifest.
+func LoadRelease(spec string, verbose bool) (*Manifest, error) {
+	if is_manifest_file(spec) {
+		return LoadManifest(spec)
+	}
+
+	env, err := NewSetup(spec, verbose)
+	if err != nil {
+		return nil, err
+	}
+	defer env.Delete()
+
+	cmt, err := New(env)
+	if err != nil {
+		return nil, err
+	}
+	return cmt.Manifest(spec)
+}
+
+// load_releases returns the manifests of all the releases in `specs`,
+// setting up at most `jobs` environments in parallel.
+func load_releases(specs []string, jobs int, opts TagDiffOptions) ([]*Manifest, error) {
+	if jobs <= 0 {
+		jobs = 1
+	}
+
+	type response struct {
+		idx int
+		m   *Manifest
+		err error
+	}
+
+	ch := make(chan response, len(specs))
+	sem := make(chan struct{}, jobs)
+	for i, spec := range specs {
+		go func(i int, spec string) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if opts.Display {
+				fmt.Printf("::: setup env. [%s]...\n", spec)
+			}
+			m, err := LoadRelease(spec, opts.Verbose)
+			ch <- response{i, m, err}
+		}(i, spec)
+	}
+
+	ms := make([]*Manifest, len(specs))
+	errs := make([]error, 0)
+	for range specs {
+		r := <-ch
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("cmt: setup of [%s] failed: %v", specs[r.idx], r.err))
+			continue
+		}
+		ms[r.idx] = r.m
+	}
+	err := combineErrors(errs...)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// is_manifest_file returns whether `spec` names a manifest file
+// (as opposed to asetup tags)
+func is_manifest_file(spec string) bool {
+	if strings.HasSuffix(spec, ".json") {
+		return true
+	}
+	fi, err := os.Stat(spec)
+	return err == nil && !fi.IsDir()
+}
+
+// short_project_name returns the name of a project without the "Atlas" prefix
+func short_project_name(name string) string {
+	if strings.HasPrefix(name, "Atlas") {
+		return name[len("Atlas"):]
+	}
+	return name
+}
+
+// EOF
@@ -0,0 +1,104 @@
+package cmt
+
+import (
+	"sort"
+)
+
+// TagMatrix holds the tags of packages across a series of releases
+// (e.g. rel_0..rel_6 of a nightly branch, or a list of patch releases)
+type TagMatrix struct {
+	Releases []string       // release identifiers, one per column
+	Rows     []TagMatrixRow // one row per package, sorted by name
+}
+
+// TagMatrixRow holds the tags of a package across a series of releases
+type TagMatrixRow struct {
+	Name     string    // package full name
+	Project  string    // project of the package in the last release holding it
+	Packages []Package // package in each release (zero if absent)
+}
+
+// Changed returns whether the package changed (tag, project or presence)
+// between releases i-1 and i
+func (row *TagMatrixRow) Changed(i int) bool {
+	if i <= 0 || i >= len(row.Packages) {
+		return false
+	}
+	return row.Packages[i] != row.Packages[i-1]
+}
+
+// Varies returns whether the package changed anywhere in the series
+func (row *TagMatrixRow) Varies() bool {
+	for i := range row.Packages {
+		if row.Changed(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// CompareReleases returns the matrix of package tags across the releases
+// `specs`, each given either as asetup tags or as the path to a manifest
+// file. At most `jobs` environments are set up in parallel.
+func CompareReleases(specs []string, jobs int, opts TagDiffOptions) (*TagMatrix, error) {
+	ms, err := load_releases(specs, jobs, opts)
+	if err != nil {
+		return nil, err
+	}
+	return CompareManifests(ms, opts), nil
+}
+
+// CompareManifests returns the matrix of package tags across the
+// release manifests `ms`.
+// Only packages whose tag varies are reported, unless opts.Unchanged is set.
+// Packages are selected with opts.Filter (kinds of changes are ignored).
+func CompareManifests(ms []*Manifest, opts TagDiffOptions) *TagMatrix {
+	m := &TagMatrix{
+		Releases: make([]string, 0, len(ms)),
+		Rows:     make([]TagMatrixRow, 0),
+	}
+
+	pkgs := make([]map[string]Package, 0, len(ms))
+	names := make(map[string]struct{})
+	for _, rel := range ms {
+		m.Releases = append(m.Releases, rel.Release)
+		p := rel.Packages()
+		for name := range p {
+			names[name] = struct{}{}
+		}
+		pkgs = append(pkgs, p)
+	}
+
+	for name := range names {
+		row := TagMatrixRow{
+			Name:     name,
+			Packages: make([]Package, len(ms)),
+		}
+		for i := range ms {
+			pkg, ok := pkgs[i][name]
+			if !ok {
+				continue
+			}
+			row.Packages[i] = pkg
+			row.Project = pkg.Project
+		}
+		if !opts.Unchanged && !row.Varies() {
+			continue
+		}
+		m.Rows = append(m.Rows, row)
+	}
+
+	sort.Sort(tagMatrixRows(m.Rows))
+	if opts.Filter != nil {
+		m = m.Filter(opts.Filter)
+	}
+	return m
+}
+
+type tagMatrixRows []TagMatrixRow
+
+func (p tagMatrixRows) Len() int           { return len(p) }
+func (p tagMatrixRows) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p tagMatrixRows) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// EOF
@@ -0,0 +1,54 @@
+//go:build !windows
+// +build !windows
+
+package cmt
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// set_process_group runs cmd in a new process group
+func set_process_group(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// kill_process_group sends sig to the process group led by p
+func kill_process_group(p *os.Process, sig syscall.Signal) error {
+	err := syscall.Kill(-p.Pid, sig)
+	if err == syscall.ESRCH {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// process_signal returns the signal which terminated the process (if any)
+func process_signal(ps *os.ProcessState) os.Signal {
+	ws, ok := ps.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return nil
+	}
+	return ws.Signal()
+}
+
+// owned_by_user returns whether the file described by `fi` belongs to
+// the current user
+func owned_by_user(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	return int(st.Uid) == os.Getuid()
+}
+
+// process_alive returns whether the process `pid` is still running
+func process_alive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// EOF
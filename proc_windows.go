@@ -0,0 +1,40 @@
+//go:build windows
+// +build windows
+
+package cmt
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// set_process_group is a no-op: there are no process groups on windows
+func set_process_group(cmd *exec.Cmd) {}
+
+// kill_process_group kills p (and only p)
+func kill_process_group(p *os.Process, sig syscall.Signal) error {
+	return p.Kill()
+}
+
+// process_signal always returns nil on windows
+func process_signal(ps *os.ProcessState) os.Signal {
+	return nil
+}
+
+// owned_by_user always returns true on windows
+func owned_by_user(fi os.FileInfo) bool {
+	return true
+}
+
+// process_alive returns whether the process `pid` is still running
+func process_alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// EOF
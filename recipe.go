@@ -0,0 +1,141 @@
+package cmt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// RecipeFromTagDiff returns the recipe checking out the packages whose tag
+// differs in `r` (changed, added or moved ones) at their new tag
+func RecipeFromTagDiff(r *TagDiffResult) Recipe {
+	rec := make(Recipe, 0)
+	for _, e := range r.Changes() {
+		if e.Kind == Removed {
+			continue
+		}
+		rec = append(rec, RecipeEntry{Package: e.Name, Version: e.New.Version})
+	}
+	sort_recipe(rec)
+	return rec
+}
+
+// DependencyQuery selects packages of a release through their dependencies
+type DependencyQuery struct {
+	Packages []string // packages the query starts from (full names or basenames)
+	Clients  bool     // select the packages using them, directly or not
+	Uses     bool     // select the packages they use, directly or not
+	Depth    int      // maximum number of dependency levels (0: no limit)
+	Projects []string // only select packages of these projects (empty: all); the starting packages are always selected
+}
+
+// QueryRecipe returns the recipe checking out the packages selected by
+// the query `q` in the release of the setup, at their release tag
+func (cmt *Cmt) QueryRecipe(q DependencyQuery) (Recipe, error) {
+	m, g, err := cmt.ReleaseDepGraph()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := m.Packages()
+	roots, err := resolve_packages(pkgs, q.Packages)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]string, len(roots))
+	for _, name := range roots {
+		versions[name] = pkgs[name].Version
+	}
+	selected := make([]string, 0)
+	if q.Clients {
+		selected = append(selected, g.AllClients(roots, q.Depth)...)
+	}
+	if q.Uses {
+		selected = append(selected, g.AllUses(roots, q.Depth)...)
+	}
+	for _, name := range selected {
+		p := pkgs[name]
+		if len(q.Projects) > 0 && !has_project_name(q.Projects, p.Project) {
+			continue
+		}
+		versions[name] = p.Version
+	}
+	return recipe_from_versions(versions), nil
+}
+
+// ImpactRecipe returns the recipe checking out the packages whose tag
+// differs in `r` at their new tag, together with all the packages of the
+// release of the setup which use them, directly or not, at their release
+// tag: the packages to rebuild to pick up the changes.
+// Clients are restricted to the projects `projects` (empty: all).
+func (cmt *Cmt) ImpactRecipe(r *TagDiffResult, projects []string) (Recipe, error) {
+	changed := RecipeFromTagDiff(r)
+
+	m, g, err := cmt.ReleaseDepGraph()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := m.Packages()
+	versions := make(map[string]string)
+	roots := make([]string, 0, len(changed))
+	for _, e := range changed {
+		versions[e.Package] = e.Version
+		if _, ok := pkgs[e.Package]; ok {
+			roots = append(roots, e.Package)
+		}
+	}
+	for _, name := range g.AllClients(roots, 0) {
+		p := pkgs[name]
+		if len(projects) > 0 && !has_project_name(projects, p.Project) {
+			continue
+		}
+		if _, ok := versions[name]; !ok {
+			versions[name] = p.Version
+		}
+	}
+	return recipe_from_versions(versions), nil
+}
+
+// resolve_packages returns the full names of the packages `names` (full
+// names or basenames) of the release packages `pkgs`
+func resolve_packages(pkgs map[string]Package, names []string) ([]string, error) {
+	out := make([]string, 0, len(names))
+	for _, name := range names {
+		if _, ok := pkgs[name]; ok {
+			out = append(out, name)
+			continue
+		}
+		cands := make([]string, 0, 1)
+		for full := range pkgs {
+			if !path_has_dir(name) && pkg_basename(full) == name {
+				cands = append(cands, full)
+			}
+		}
+		switch len(cands) {
+		case 0:
+			return nil, fmt.Errorf("cmt: package [%s] not found in release", name)
+		case 1:
+			out = append(out, cands[0])
+		default:
+			sort.Strings(cands)
+			return nil, fmt.Errorf("cmt: ambiguous package [%s] (%v)", name, cands)
+		}
+	}
+	return out, nil
+}
+
+func recipe_from_versions(versions map[string]string) Recipe {
+	rec := make(Recipe, 0, len(versions))
+	for name, version := range versions {
+		rec = append(rec, RecipeEntry{Package: name, Version: version})
+	}
+	sort_recipe(rec)
+	return rec
+}
+
+func sort_recipe(rec Recipe) {
+	sort.Slice(rec, func(i, j int) bool {
+		return rec[i].Package < rec[j].Package
+	})
+}
+
+// EOF
@@ -0,0 +1,579 @@
+package cmt
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Renderer formats tag differences for display
+type Renderer interface {
+	// RenderTagDiff writes the tag differences `r` into `w`
+	RenderTagDiff(w io.Writer, r *TagDiffResult) error
+
+	// RenderTagMatrix writes the matrix of tags `m` into `w`
+	RenderTagMatrix(w io.Writer, m *TagMatrix) error
+}
+
+// Formats lists the output formats supported by NewRenderer
+var Formats = []string{"text", "json", "csv", "markdown", "html"}
+
+// NewRenderer returns the Renderer for the output format `format`
+// (one of Formats)
+func NewRenderer(format string) (Renderer, error) {
+	switch strings.ToLower(format) {
+	case "text", "txt", "":
+		return TextRenderer{}, nil
+	case "json":
+		return JSONRenderer{}, nil
+	case "csv":
+		return CSVRenderer{}, nil
+	case "markdown", "md":
+		return MarkdownRenderer{}, nil
+	case "html":
+		return HTMLRenderer{}, nil
+	}
+	return nil, fmt.Errorf("cmt: unknown output format [%s]", format)
+}
+
+// short_version returns the version of a package without the package
+// name prefix (e.g. "01-02-03" for "AthenaKernel-01-02-03")
+func short_version(p Package) string {
+	if p.Version == "" {
+		return ""
+	}
+	if t, err := ParseTag(p.Version); err == nil && t.BelongsTo(p.Name) {
+		return t.Short()
+	}
+	return strings.Replace(p.Version, p.Base()+"-", "", -1)
+}
+
+// or_dash returns "-" for empty strings
+func or_dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// sorted_projects returns the names of the projects in `counts`, sorted
+func sorted_projects(counts map[string]map[ChangeKind]int) []string {
+	projs := make([]string, 0, len(counts))
+	for proj := range counts {
+		projs = append(projs, proj)
+	}
+	sort.Strings(projs)
+	return projs
+}
+
+// kind_label returns the kind of change of an entry, flagging versions
+// ahead (+) or behind (-) and packages with uncommitted changes (*)
+func kind_label(e TagDiffEntry) string {
+	label := e.Kind.String()
+	switch {
+	case e.Kind == Unchanged:
+	case e.Ahead():
+		label += "+"
+	case e.Behind():
+		label += "-"
+	}
+	if e.Modified {
+		label += "*"
+	}
+	return label
+}
+
+// TextRenderer renders tag differences as an aligned text table
+type TextRenderer struct{}
+
+func (TextRenderer) RenderTagDiff(w io.Writer, r *TagDiffResult) error {
+	format := "%-15s %-15s | %-15s %-15s | %-9s | %-45s\n"
+	_, err := fmt.Fprintf(w, format, "old", "old-proj", "new", "new-project", "change", "pkg-name")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 132))
+	for _, e := range r.Entries {
+		_, err = fmt.Fprintf(w, format,
+			or_dash(short_version(e.Old)), or_dash(e.Old.Project),
+			or_dash(short_version(e.New)), or_dash(e.New.Project),
+			kind_label(e),
+			e.Name,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 132))
+	_, err = fmt.Fprintf(w, "::: found [%d] tags which are different\n", len(r.Changes()))
+	return err
+}
+
+func (TextRenderer) RenderTagMatrix(w io.Writer, m *TagMatrix) error {
+	width := 12
+	for _, rel := range m.Releases {
+		if len(rel)+1 > width {
+			width = len(rel) + 1
+		}
+	}
+	_, err := fmt.Fprintf(w, "%-45s %-15s", "pkg-name", "project")
+	if err != nil {
+		return err
+	}
+	for _, rel := range m.Releases {
+		fmt.Fprintf(w, " | %-*s", width, rel)
+	}
+	fmt.Fprintf(w, "\n%s\n", strings.Repeat("-", 61+len(m.Releases)*(width+3)))
+	for _, row := range m.Rows {
+		fmt.Fprintf(w, "%-45s %-15s", row.Name, or_dash(row.Project))
+		for i, pkg := range row.Packages {
+			v := or_dash(short_version(pkg))
+			if row.Changed(i) {
+				v += "*"
+			}
+			fmt.Fprintf(w, " | %-*s", width, v)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 61+len(m.Releases)*(width+3)))
+	_, err = fmt.Fprintf(w, "::: found [%d] packages (* marks a change w.r.t. the previous release)\n", len(m.Rows))
+	return err
+}
+
+// JSONRenderer renders tag differences as a JSON document
+type JSONRenderer struct{}
+
+type jsonPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Short   string `json:"short"`
+	Project string `json:"project"`
+}
+
+type jsonEntry struct {
+	Name     string       `json:"name"`
+	Kind     string       `json:"kind"`
+	Old      *jsonPackage `json:"old,omitempty"`
+	New      *jsonPackage `json:"new,omitempty"`
+	Order    int          `json:"order,omitempty"`
+	Modified bool         `json:"modified,omitempty"`
+}
+
+type jsonTagDiff struct {
+	Old         string                    `json:"old"`
+	New         string                    `json:"new"`
+	OldProjects []ReleaseProject          `json:"old_projects"`
+	NewProjects []ReleaseProject          `json:"new_projects"`
+	Entries     []jsonEntry               `json:"entries"`
+	ByKind      map[string]int            `json:"by_kind"`
+	ByProject   map[string]map[string]int `json:"by_project"`
+}
+
+func json_package(p Package) *jsonPackage {
+	if p.Name == "" {
+		return nil
+	}
+	return &jsonPackage{
+		Name:    p.Name,
+		Version: p.Version,
+		Short:   short_version(p),
+		Project: p.Project,
+	}
+}
+
+func (JSONRenderer) RenderTagDiff(w io.Writer, r *TagDiffResult) error {
+	out := jsonTagDiff{
+		Old:         r.Old,
+		New:         r.New,
+		OldProjects: r.OldProjects,
+		NewProjects: r.NewProjects,
+		Entries:     make([]jsonEntry, 0, len(r.Entries)),
+		ByKind:      make(map[string]int),
+		ByProject:   make(map[string]map[string]int),
+	}
+	for _, e := range r.Entries {
+		out.Entries = append(out.Entries, jsonEntry{
+			Name:     e.Name,
+			Kind:     e.Kind.String(),
+			Old:      json_package(e.Old),
+			New:      json_package(e.New),
+			Order:    e.Order,
+			Modified: e.Modified,
+		})
+	}
+	for k, n := range r.CountByKind() {
+		out.ByKind[k.String()] = n
+	}
+	for proj, counts := range r.CountByProject() {
+		out.ByProject[proj] = make(map[string]int)
+		for k, n := range counts {
+			out.ByProject[proj][k.String()] = n
+		}
+	}
+
+	data, err := json.MarshalIndent(&out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+type jsonMatrixRow struct {
+	Name     string   `json:"name"`
+	Project  string   `json:"project"`
+	Versions []string `json:"versions"`
+	Changed  []bool   `json:"changed"`
+}
+
+type jsonTagMatrix struct {
+	Releases []string        `json:"releases"`
+	Rows     []jsonMatrixRow `json:"rows"`
+}
+
+func (JSONRenderer) RenderTagMatrix(w io.Writer, m *TagMatrix) error {
+	out := jsonTagMatrix{
+		Releases: m.Releases,
+		Rows:     make([]jsonMatrixRow, 0, len(m.Rows)),
+	}
+	for _, row := range m.Rows {
+		jrow := jsonMatrixRow{
+			Name:     row.Name,
+			Project:  row.Project,
+			Versions: make([]string, len(row.Packages)),
+			Changed:  make([]bool, len(row.Packages)),
+		}
+		for i, pkg := range row.Packages {
+			jrow.Versions[i] = short_version(pkg)
+			jrow.Changed[i] = row.Changed(i)
+		}
+		out.Rows = append(out.Rows, jrow)
+	}
+
+	data, err := json.MarshalIndent(&out, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// CSVRenderer renders tag differences as comma-separated values,
+// one package per row
+type CSVRenderer struct{}
+
+func (CSVRenderer) RenderTagDiff(w io.Writer, r *TagDiffResult) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{
+		"package", "change",
+		"old-version", "old-project",
+		"new-version", "new-project",
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range r.Entries {
+		err = cw.Write([]string{
+			e.Name, e.Kind.String(),
+			short_version(e.Old), e.Old.Project,
+			short_version(e.New), e.New.Project,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (CSVRenderer) RenderTagMatrix(w io.Writer, m *TagMatrix) error {
+	cw := csv.NewWriter(w)
+	// the "changed" column lists the releases where the tag changed
+	// w.r.t. the previous one
+	header := append([]string{"package", "project"}, m.Releases...)
+	err := cw.Write(append(header, "changed"))
+	if err != nil {
+		return err
+	}
+	for _, row := range m.Rows {
+		rec := []string{row.Name, row.Project}
+		changed := make([]string, 0)
+		for i, pkg := range row.Packages {
+			rec = append(rec, short_version(pkg))
+			if row.Changed(i) {
+				changed = append(changed, m.Releases[i])
+			}
+		}
+		err = cw.Write(append(rec, strings.Join(changed, " ")))
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// MarkdownRenderer renders tag differences as GitHub-flavoured Markdown
+type MarkdownRenderer struct{}
+
+func (MarkdownRenderer) RenderTagDiff(w io.Writer, r *TagDiffResult) error {
+	_, err := fmt.Fprintf(w, "## Tag differences: `%s` → `%s`\n\n", r.Old, r.New)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "| Package | Change | Old | Old project | New | New project |\n")
+	fmt.Fprintf(w, "|---|---|---|---|---|---|\n")
+	for _, e := range r.Entries {
+		fmt.Fprintf(w, "| `%s` | %s | %s | %s | %s | %s |\n",
+			e.Name, kind_label(e),
+			or_dash(short_version(e.Old)), or_dash(e.Old.Project),
+			or_dash(short_version(e.New)), or_dash(e.New.Project),
+		)
+	}
+
+	fmt.Fprintf(w, "\n### Summary\n\n")
+	fmt.Fprintf(w, "| Project |")
+	for _, k := range ChangeKinds {
+		fmt.Fprintf(w, " %s |", k)
+	}
+	fmt.Fprintf(w, "\n|---|")
+	for range ChangeKinds {
+		fmt.Fprintf(w, "---|")
+	}
+	fmt.Fprintf(w, "\n")
+	counts := r.CountByProject()
+	for _, proj := range sorted_projects(counts) {
+		fmt.Fprintf(w, "| %s |", or_dash(proj))
+		for _, k := range ChangeKinds {
+			fmt.Fprintf(w, " %d |", counts[proj][k])
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	_, err = fmt.Fprintf(w, "\nFound **%d** tags which are different.\n", len(r.Changes()))
+	return err
+}
+
+func (MarkdownRenderer) RenderTagMatrix(w io.Writer, m *TagMatrix) error {
+	_, err := fmt.Fprintf(w, "## Tags across %d releases\n\n| Package | Project |", len(m.Releases))
+	if err != nil {
+		return err
+	}
+	for _, rel := range m.Releases {
+		fmt.Fprintf(w, " `%s` |", rel)
+	}
+	fmt.Fprintf(w, "\n|---|---|")
+	for range m.Releases {
+		fmt.Fprintf(w, "---|")
+	}
+	fmt.Fprintf(w, "\n")
+	for _, row := range m.Rows {
+		fmt.Fprintf(w, "| `%s` | %s |", row.Name, or_dash(row.Project))
+		for i, pkg := range row.Packages {
+			v := or_dash(short_version(pkg))
+			if row.Changed(i) {
+				v = "**" + v + "**"
+			}
+			fmt.Fprintf(w, " %s |", v)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	_, err = fmt.Fprintf(w, "\nFound **%d** packages; changes w.r.t. the previous release are in bold.\n", len(m.Rows))
+	return err
+}
+
+// HTMLRenderer renders tag differences as a self-contained HTML page,
+// with a table which can be sorted by column and filtered by project
+type HTMLRenderer struct{}
+
+type htmlRow struct {
+	Name       string
+	Kind       string
+	OldVersion string
+	OldProject string
+	NewVersion string
+	NewProject string
+	Project    string
+}
+
+func (HTMLRenderer) RenderTagDiff(w io.Writer, r *TagDiffResult) error {
+	rows := make([]htmlRow, 0, len(r.Entries))
+	for _, e := range r.Entries {
+		rows = append(rows, htmlRow{
+			Name:       e.Name,
+			Kind:       e.Kind.String(),
+			OldVersion: or_dash(short_version(e.Old)),
+			OldProject: or_dash(e.Old.Project),
+			NewVersion: or_dash(short_version(e.New)),
+			NewProject: or_dash(e.New.Project),
+			Project:    e.Project(),
+		})
+	}
+	return html_tagdiff.Execute(w, map[string]interface{}{
+		"Old":      r.Old,
+		"New":      r.New,
+		"Rows":     rows,
+		"Projects": sorted_projects(r.CountByProject()),
+		"Changes":  len(r.Changes()),
+	})
+}
+
+type htmlCell struct {
+	Version string
+	Changed bool
+}
+
+type htmlMatrixRow struct {
+	Name    string
+	Project string
+	Cells   []htmlCell
+}
+
+func (HTMLRenderer) RenderTagMatrix(w io.Writer, m *TagMatrix) error {
+	rows := make([]htmlMatrixRow, 0, len(m.Rows))
+	projs := make(map[string]map[ChangeKind]int)
+	for _, row := range m.Rows {
+		hrow := htmlMatrixRow{
+			Name:    row.Name,
+			Project: row.Project,
+			Cells:   make([]htmlCell, 0, len(row.Packages)),
+		}
+		for i, pkg := range row.Packages {
+			hrow.Cells = append(hrow.Cells, htmlCell{
+				Version: or_dash(short_version(pkg)),
+				Changed: row.Changed(i),
+			})
+		}
+		rows = append(rows, hrow)
+		projs[row.Project] = nil
+	}
+	return html_tagmatrix.Execute(w, map[string]interface{}{
+		"Releases": m.Releases,
+		"Rows":     rows,
+		"Projects": sorted_projects(projs),
+	})
+}
+
+// html_script implements sorting and filtering of the tables of HTML pages
+const html_script = `
+function filterRows() {
+  var proj = document.getElementById("project").value;
+  var rows = document.querySelectorAll("table.sortable tbody tr");
+  for (var i = 0; i < rows.length; i++) {
+    var show = proj === "" || rows[i].getAttribute("data-project") === proj;
+    rows[i].style.display = show ? "" : "none";
+  }
+}
+function sortTable(th) {
+  var table = th.closest("table");
+  var col = Array.prototype.indexOf.call(th.parentNode.children, th);
+  var asc = th.getAttribute("data-order") !== "asc";
+  th.setAttribute("data-order", asc ? "asc" : "desc");
+  var body = table.tBodies[0];
+  var rows = Array.prototype.slice.call(body.rows);
+  rows.sort(function(a, b) {
+    var x = a.cells[col].textContent, y = b.cells[col].textContent;
+    return asc ? x.localeCompare(y) : y.localeCompare(x);
+  });
+  for (var i = 0; i < rows.length; i++) {
+    body.appendChild(rows[i]);
+  }
+}
+`
+
+// html_style is the stylesheet of HTML pages
+const html_style = `
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+th { background: #eee; cursor: pointer; }
+td.version { font-family: monospace; }
+tr.added { background: #e6ffed; }
+tr.removed { background: #ffeef0; }
+tr.changed { background: #fff5b1; }
+tr.moved { background: #fff5d6; }
+td.changed { background: #fff5b1; }
+`
+
+var html_tagdiff = template.Must(template.New("tagdiff").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tag differences: {{.Old}} → {{.New}}</title>
+<style>` + html_style + `</style>
+<script>` + html_script + `</script>
+</head>
+<body>
+<h1>Tag differences: <code>{{.Old}}</code> → <code>{{.New}}</code></h1>
+<p>
+<label for="project">Project:</label>
+<select id="project" onchange="filterRows()">
+<option value="">(all)</option>
+{{range .Projects}}<option value="{{.}}">{{.}}</option>
+{{end}}</select>
+</p>
+<table class="sortable">
+<thead>
+<tr>
+<th onclick="sortTable(this)">Package</th>
+<th onclick="sortTable(this)">Change</th>
+<th onclick="sortTable(this)">Old</th>
+<th onclick="sortTable(this)">Old project</th>
+<th onclick="sortTable(this)">New</th>
+<th onclick="sortTable(this)">New project</th>
+</tr>
+</thead>
+<tbody>
+{{range .Rows}}<tr class="{{.Kind}}" data-project="{{.Project}}">
+<td>{{.Name}}</td><td>{{.Kind}}</td>
+<td class="version">{{.OldVersion}}</td><td>{{.OldProject}}</td>
+<td class="version">{{.NewVersion}}</td><td>{{.NewProject}}</td>
+</tr>
+{{end}}</tbody>
+</table>
+<p>Found <b>{{.Changes}}</b> tags which are different.</p>
+</body>
+</html>
+`))
+
+var html_tagmatrix = template.Must(template.New("tagmatrix").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Tags across {{len .Releases}} releases</title>
+<style>` + html_style + `</style>
+<script>` + html_script + `</script>
+</head>
+<body>
+<h1>Tags across {{len .Releases}} releases</h1>
+<p>
+<label for="project">Project:</label>
+<select id="project" onchange="filterRows()">
+<option value="">(all)</option>
+{{range .Projects}}<option value="{{.}}">{{.}}</option>
+{{end}}</select>
+</p>
+<table class="sortable">
+<thead>
+<tr>
+<th onclick="sortTable(this)">Package</th>
+<th onclick="sortTable(this)">Project</th>
+{{range .Releases}}<th onclick="sortTable(this)">{{.}}</th>
+{{end}}</tr>
+</thead>
+<tbody>
+{{range .Rows}}<tr data-project="{{.Project}}">
+<td>{{.Name}}</td><td>{{.Project}}</td>
+{{range .Cells}}<td class="version{{if .Changed}} changed{{end}}">{{.Version}}</td>
+{{end}}</tr>
+{{end}}</tbody>
+</table>
+<p>Found <b>{{len .Rows}}</b> packages; changes w.r.t. the previous release are highlighted.</p>
+</body>
+</html>
+`))
+
+// EOF
@@ -0,0 +1,123 @@
+package cmt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultRepoRules are the rules used for packages matched by no rule of
+// the repository rules file: Gaudi packages live in $GAUDISVN and all the
+// others in $SVNROOT.
+var DefaultRepoRules = []RepoRule{
+	{
+		Pattern: "Gaudi*",
+		URL:     "${GAUDISVN:-http://svnweb.cern.ch/guest/gaudi}",
+		Type:    "svn",
+		Layout:  GaudiLayout,
+	},
+	{
+		Pattern: "*",
+		URL:     "$SVNROOT",
+		Type:    "svn",
+		Layout:  StandardLayout,
+	},
+}
+
+// ReadRepoRules reads repository rules from a JSON document listing the
+// rules in order of precedence, e.g.:
+//
+//	{"rules": [
+//	  {"pattern": "tdaq-common*", "url": "$TDAQ_SVN", "layout":
+//	    {"trunk": "{pkg}/trunk", "tags": "{pkg}/tags", "branches": "{pkg}/branches"}},
+//	  {"pattern": "LCG_*", "url": "https://gitlab.cern.ch/lcg/{name}.git", "type": "git",
+//	   "credentials": "kinit user@CERN.CH"}
+//	]}
+func ReadRepoRules(r io.Reader) ([]RepoRule, error) {
+	var doc struct {
+		Rules []RepoRule `json:"rules"`
+	}
+	err := json.NewDecoder(r).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("cmt: could not decode repository rules: %v", err)
+	}
+	for i, rule := range doc.Rules {
+		if rule.Pattern == "" || rule.URL == "" {
+			return nil, fmt.Errorf("cmt: repository rule #%d needs a pattern and a url", i)
+		}
+		vcs, err := NewVCS(rule.Type, nil)
+		if err != nil {
+			return nil, err
+		}
+		if vcs.Type() == "git" && rule.Layout != (RepoLayout{}) {
+			return nil, fmt.Errorf("cmt: repository rule #%d: git repositories hold a single package and have no layout", i)
+		}
+	}
+	return doc.Rules, nil
+}
+
+// LoadRepoRules reads repository rules from the file `fname`
+func LoadRepoRules(fname string) ([]RepoRule, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := ReadRepoRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v (file [%s])", err, fname)
+	}
+	return rules, nil
+}
+
+// repo_rules_fname returns the repository rules file of the environment
+// `env`: $GO_CMT_REPOS (from the setup, then from the current process),
+// or repos.json under the go-cmt user configuration directory.
+// It returns "" if there is none.
+func repo_rules_fname(env *Setup) string {
+	if env != nil {
+		if fname := env.Getenv("GO_CMT_REPOS"); fname != "" {
+			return fname
+		}
+	}
+	if fname := os.Getenv("GO_CMT_REPOS"); fname != "" {
+		return fname
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	fname := filepath.Join(dir, "go-cmt", "repos.json")
+	if !path_exists(fname) {
+		return ""
+	}
+	return fname
+}
+
+// RepoRules returns the rules mapping packages to their repository: the
+// rules of the repository rules file, followed by DefaultRepoRules
+func (cmt *Cmt) RepoRules() ([]RepoRule, error) {
+	rules := make([]RepoRule, 0, len(DefaultRepoRules))
+	if fname := repo_rules_fname(cmt.env); fname != "" {
+		cmt.debugf("loading repository rules from [%s]...\n", fname)
+		r, err := LoadRepoRules(fname)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r...)
+	}
+	return append(rules, DefaultRepoRules...), nil
+}
+
+// Repository returns the repository holding the sources of `pkg`
+func (cmt *Cmt) Repository(pkg string) (*Repository, error) {
+	rules, err := cmt.RepoRules()
+	if err != nil {
+		return nil, err
+	}
+	return ResolveRepository(rules, pkg, cmt.env)
+}
+
+// EOF
@@ -8,17 +8,22 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/atlas-org/shell"
 )
 
-// Setup manages a CMT environment
+// Setup manages a CMT environment.
+// Its methods are safe for concurrent use: the accesses to the subshell
+// are serialized.
 type Setup struct {
-	name    string      // project name
-	topdir  string      // directory holding the whole project/workarea
-	remove  bool        // switch whether to remove or not the topdir
-	asetup  string      // path to asetup.sh
-	sh      shell.Shell // subshell where CMT is configured
+	name    string   // project name
+	topdir  string   // directory holding the whole project/workarea
+	owned   bool     // whether topdir was created by this Setup, and is removed by Delete
+	reused  bool     // whether topdir held a previous asetup configuration
+	deleted bool     // whether Delete was called (guarded by the registry lock)
+	asetup  string   // path to asetup.sh
+	sh      subshell // subshell where CMT is configured
 	verbose bool
 }
 
@@ -33,23 +38,58 @@ func NewSetup(tags string, verbose bool) (*Setup, error) {
 	if tags == "" {
 		return newSetup("<local>", "", tags, verbose)
 	}
-	return newSetup(project, asetup_root, tags, verbose)
+	return newCachedSetup(DefaultEnvCache, project, asetup_root, tags, verbose)
+}
+
+// NewSetupWithCache returns a Cmt Setup configured with the given tags,
+// reusing the environment stored in `cache` if it is still fresh and
+// storing it there otherwise.
+func NewSetupWithCache(tags string, cache *EnvCache, verbose bool) (*Setup, error) {
+	project := os.Getenv("AtlasProject")
+	if project == "" {
+		project = "AtlasOffline"
+	}
+
+	asetup_root := "/afs/cern.ch/atlas/software/dist/AtlasSetup"
+	if tags == "" {
+		return newSetup("<local>", "", tags, verbose)
+	}
+	return newCachedSetup(cache, project, asetup_root, tags, verbose)
 }
 
 // NewSetupFromCache returns a Cmt setup from a previously cached environment
 func NewSetupFromCache(fname, topdir string, verbose bool) (*Setup, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return newSetupFromReader(f, topdir, verbose)
+}
+
+// newSetupFromReader returns a Cmt setup from an environment encoded in `r`
+func newSetupFromReader(r io.Reader, topdir string, verbose bool) (*Setup, error) {
 	var err error
-	remove := false
+	owned := false
 	if topdir == "" {
-		topdir, err = ioutil.TempDir("", "atl-cmt-mgr-")
+		topdir, err = ioutil.TempDir("", tmpdir_prefix)
+		if err != nil {
+			return nil, err
+		}
+		owned = true
+		err = write_owner(topdir)
 		if err != nil {
+			os.RemoveAll(topdir)
 			return nil, err
 		}
-		remove = true
 	}
 
 	sh, err := shell.New()
 	if err != nil {
+		if owned {
+			os.RemoveAll(topdir)
+		}
 		return nil, err
 	}
 
@@ -59,20 +99,14 @@ func NewSetupFromCache(fname, topdir string, verbose bool) (*Setup, error) {
 	s := &Setup{
 		name:    project,
 		topdir:  topdir,
-		remove:  remove,
+		owned:   owned,
 		asetup:  filepath.Join(asetup_root, "scripts", "asetup.sh"),
-		sh:      sh,
+		sh:      subshell{sh: sh},
 		verbose: verbose,
 	}
+	track(s)
 
-	f, err := os.Open(fname)
-	if err != nil {
-		s.Delete()
-		return nil, err
-	}
-	defer f.Close()
-
-	err = s.Load(f)
+	err = s.Load(r)
 	if err != nil {
 		s.Delete()
 		return nil, err
@@ -92,25 +126,32 @@ func NewSetupFromCache(fname, topdir string, verbose bool) (*Setup, error) {
 
 func newSetup(project, asetup_root, tags string, verbose bool) (*Setup, error) {
 
-	topdir, err := ioutil.TempDir("", "atl-cmt-mgr-")
+	topdir, err := ioutil.TempDir("", tmpdir_prefix)
 	if err != nil {
 		return nil, err
 	}
+	err = write_owner(topdir)
+	if err != nil {
+		os.RemoveAll(topdir)
+		return nil, err
+	}
 
 	sh, err := shell.New()
 	if err != nil {
 		sh.Delete()
+		os.RemoveAll(topdir)
 		return nil, err
 	}
 
 	s := &Setup{
 		name:    project,
 		topdir:  topdir,
-		remove:  true,
+		owned:   true,
 		asetup:  filepath.Join(asetup_root, "scripts", "asetup.sh"),
-		sh:      sh,
+		sh:      subshell{sh: sh},
 		verbose: verbose,
 	}
+	track(s)
 	err = s.init()
 	if err != nil {
 		s.Delete()
@@ -128,6 +169,97 @@ func newSetup(project, asetup_root, tags string, verbose bool) (*Setup, error) {
 	return s, nil
 }
 
+// NewSetupIn returns a Cmt Setup rooted in the persistent work area `dir`,
+// configured with the given tags.
+// `dir` is created if it does not exist and is never removed by Delete.
+// If `tags` is empty, the configuration saved by a previous asetup in
+// that work area (.asetup.save) is restored.
+func NewSetupIn(dir, tags string, verbose bool) (*Setup, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := filepath.Join(dir, ".asetup.save")
+	reused := path_exists(saved)
+	if tags == "" && !reused {
+		return nil, fmt.Errorf("cmt: no asetup tags given and no .asetup.save in [%s]", dir)
+	}
+
+	created := false
+	if !path_exists(dir) {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		created = true
+	}
+	// the work area is kept by Delete, but not if it was created for
+	// a setup which failed
+	fail := func(s *Setup, err error) (*Setup, error) {
+		if s != nil {
+			s.Delete()
+		}
+		if created {
+			os.RemoveAll(dir)
+		}
+		return nil, err
+	}
+
+	sh, err := shell.New()
+	if err != nil {
+		return fail(nil, err)
+	}
+
+	asetup_root := "/afs/cern.ch/atlas/software/dist/AtlasSetup"
+
+	s := &Setup{
+		name:    "AtlasOffline",
+		topdir:  dir,
+		owned:   false,
+		reused:  reused,
+		asetup:  filepath.Join(asetup_root, "scripts", "asetup.sh"),
+		sh:      subshell{sh: sh},
+		verbose: verbose,
+	}
+	track(s)
+	err = s.init()
+	if err != nil {
+		return fail(s, err)
+	}
+
+	if tags == "" {
+		err = s.source_asetup("--input=" + saved)
+	} else {
+		err = s.create_asetup_cfg(tags)
+	}
+	if err != nil {
+		return fail(s, err)
+	}
+
+	if project := s.sh.Getenv("AtlasProject"); project != "" {
+		s.name = project
+	}
+	return s, nil
+}
+
+// TopDir returns the directory holding the work area of this Setup
+func (s *Setup) TopDir() string {
+	return s.topdir
+}
+
+// Reused returns whether the work area held a previous asetup configuration
+// (.asetup.save) when this Setup was created
+func (s *Setup) Reused() bool {
+	return s.reused
+}
+
+// Packages returns the full names of the packages checked out in the
+// work area (the directories holding a cmt/requirements file), sorted.
+func (s *Setup) Packages() ([]string, error) {
+	return scan_packages(s.topdir)
+}
+
 func (s *Setup) init() error {
 	var err error
 
@@ -142,6 +274,13 @@ func (s *Setup) init() error {
 func (s *Setup) create_asetup_cfg(tags string) error {
 	var err error
 	fname := filepath.Join(s.topdir, ".asetup.cfg")
+	if path_exists(fname) {
+		// do not clobber the configuration of a persistent work area
+		if s.verbose {
+			fmt.Printf("cmt: reusing [%s]...\n", fname)
+		}
+		return s.source_asetup("--input="+fname, tags)
+	}
 	if s.verbose {
 		fmt.Printf("cmt: create [%s]...\n", fname)
 	}
@@ -185,7 +324,11 @@ cvmfs = releasesarea=/cvmfs/atlas.cern.ch/software/$CMTCONFIG:/afs/cern.ch/atlas
 		return err
 	}
 	// source it
-	args := []string{"--input=" + fname, tags}
+	return s.source_asetup("--input="+fname, tags)
+}
+
+// source_asetup sources asetup with `args` in the subshell
+func (s *Setup) source_asetup(args ...string) error {
 	if s.verbose {
 		fmt.Printf("cmt: sourcing 'asetup %v'...\n", args)
 	}
@@ -208,9 +351,16 @@ cvmfs = releasesarea=/cvmfs/atlas.cern.ch/software/$CMTCONFIG:/afs/cern.ch/atlas
 	return err
 }
 
+// Delete releases the resources held by this Setup.
+// The topdir is removed only if it was created by this Setup and is not
+// a persistent work area.
 func (s *Setup) Delete() error {
 	var err error
-	if s.remove {
+	if !untrack(s) {
+		// already deleted
+		return nil
+	}
+	if s.owned {
 		err = os.RemoveAll(s.topdir)
 	}
 	return combineErrors(
@@ -246,11 +396,15 @@ func (s *Setup) Load(r io.Reader) error {
 	// restore workdir
 	defer s.sh.Chdir(wd)
 
-	tmp, err := ioutil.TempDir("", "atl-cmt-mgr-load-")
+	tmp, err := ioutil.TempDir("", tmpdir_prefix+"load-")
 	if err != nil {
 		return err
 	}
 	defer os.RemoveAll(tmp)
+	err = write_owner(tmp)
+	if err != nil {
+		return err
+	}
 
 	fname := filepath.Join(tmp, "store.cmt")
 	f, err := os.Create(fname)
@@ -271,8 +425,12 @@ func (s *Setup) Load(r io.Reader) error {
 	}
 
 	for k, v := range data {
+		if !is_shell_identifier(k) {
+			// e.g. exported bash functions (BASH_FUNC_xxx%%)
+			continue
+		}
 		v = strings.Replace(v, "@@GO_CMT_TOPDIR@@", s.topdir, -1)
-		_, err = f.WriteString(fmt.Sprintf("export %s=%q\n", k, v))
+		_, err = f.WriteString(export_line(k, v))
 		if err != nil {
 			return err
 		}
@@ -289,6 +447,70 @@ func (s *Setup) Load(r io.Reader) error {
 	return err
 }
 
+// Getenv returns the value of the environment variable `key`
+// in the setup's subshell
+func (s *Setup) Getenv(key string) string {
+	return s.sh.Getenv(key)
+}
+
+// Setenv sets the environment variable `key` to `value` in the setup's subshell
+func (s *Setup) Setenv(key, value string) error {
+	return s.setenv(map[string]string{key: value})
+}
+
+// setenv exports all the variables in `vars` into the subshell
+func (s *Setup) setenv(vars map[string]string) error {
+	f, err := ioutil.TempFile("", tmpdir_prefix+"env-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	for k, v := range vars {
+		if !is_shell_identifier(k) {
+			return fmt.Errorf("cmt.setup: invalid environment variable name %q", k)
+		}
+		_, err = f.WriteString(export_line(k, v))
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	bout, err := s.sh.Source(f.Name())
+	if err != nil {
+		return fmt.Errorf("cmt.setup: error setting environment: %v\n%v", err, string(bout))
+	}
+	return err
+}
+
+// export_line returns the shell statement exporting `value` verbatim
+// into the variable `key`: the value is single-quoted, so the shell does
+// not expand $VAR, `cmd` or $(cmd) in it.
+func export_line(key, value string) string {
+	return "export " + key + "='" + strings.Replace(value, "'", `'\''`, -1) + "'\n"
+}
+
+// is_shell_identifier returns whether `name` is a valid shell variable name
+func is_shell_identifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Setup) EnvMap() map[string]string {
 	dict := make(map[string]string)
 	for _, env := range s.sh.Environ() {
@@ -328,4 +550,53 @@ func combineErrors(errs ...error) error {
 	return merror{stack}
 }
 
+// subshell serializes the accesses to a shell, which runs the commands it
+// is sent one at a time
+type subshell struct {
+	mu sync.Mutex
+	sh shell.Shell
+}
+
+func (sh *subshell) Run(cmd string, args ...string) ([]byte, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Run(cmd, args...)
+}
+
+func (sh *subshell) Source(script string, args ...string) ([]byte, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Source(script, args...)
+}
+
+func (sh *subshell) Chdir(dir string) error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Chdir(dir)
+}
+
+func (sh *subshell) Getwd() (string, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Getwd()
+}
+
+func (sh *subshell) Getenv(key string) string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Getenv(key)
+}
+
+func (sh *subshell) Environ() []string {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Environ()
+}
+
+func (sh *subshell) Delete() error {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.sh.Delete()
+}
+
 // EOF
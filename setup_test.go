@@ -0,0 +1,62 @@
+package cmt
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestExportLine(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+	for _, value := range []string{
+		"",
+		"plain",
+		"with spaces and\ttabs",
+		"$HOME and ${PATH:-x}",
+		"`touch /tmp/go-cmt-pwned` and $(touch /tmp/go-cmt-pwned)",
+		"it's 'quoted'",
+		`back\slash "double" \n`,
+		"multi\nline",
+		"unicode: é ✓",
+	} {
+		script := export_line("GOCMT_VALUE", value) + `printf '%s' "$GOCMT_VALUE"`
+		out, err := exec.Command("sh", "-c", script).CombinedOutput()
+		if err != nil {
+			t.Errorf("%q: %v\n%s", value, err, out)
+			continue
+		}
+		if string(out) != value {
+			t.Errorf("%q: got %q", value, out)
+		}
+	}
+}
+
+func TestShellIdentifier(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"TestArea", true},
+		{"_", true},
+		{"CMTCONFIG", true},
+		{"ROOT_6", true},
+		{"", false},
+		{"6ROOT", false},
+		{"A-B", false},
+		{"A B", false},
+		{"BASH_FUNC_module%%", false},
+		{"X=Y", false},
+		{"$(id)", false},
+	} {
+		if got := is_shell_identifier(tc.name); got != tc.want {
+			t.Errorf("%q: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if strings.Count(export_line("A", "a'b"), "'") != 5 {
+		t.Errorf("unexpected quoting: %s", export_line("A", "a'b"))
+	}
+}
+
+// EOF
@@ -0,0 +1,505 @@
+package cmt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SourceDiffOptions configures the computation of source-level differences
+type SourceDiffOptions struct {
+	Exclude     []string // glob patterns of files and directories to ignore (default: DefaultSourceExcludes)
+	MaxFileSize int64    // files larger than that (in bytes) are not diffed (default: DefaultMaxSourceSize, <0: no limit)
+	MaxLines    int      // maximum number of diff lines per package (0: no limit)
+	Context     int      // number of context lines (default: 3)
+}
+
+// DefaultMaxSourceSize is the size (in bytes) above which files are
+// reported as too large and not diffed
+const DefaultMaxSourceSize = 2 << 20
+
+// DefaultSourceExcludes lists the generated files and directories ignored
+// by source diffs.
+// Patterns with a '/' match the path relative to the package directory,
+// the others match file names.
+var DefaultSourceExcludes = []string{
+	".svn", ".git", "CVS",
+	"i686-*", "x86_64-*", // CMTCONFIG build directories
+	"genConf", "*.pyc", "*.o", "*.so", "*.a", "*.d",
+	"*.make", "cmt/Makefile", "cmt/setup.*", "cmt/cleanup.*", "*.stamp", "install.history",
+}
+
+// PackageSourceDiff is the source-level difference of a package between
+// two installed releases
+type PackageSourceDiff struct {
+	Entry     TagDiffEntry // the tag difference
+	OldDir    string       // directory of the package in the old release ("" if not found)
+	NewDir    string       // directory of the package in the new release ("" if not found)
+	Files     []FileDiff   // files which differ, sorted by name
+	Truncated bool         // whether the diff was truncated (MaxLines)
+}
+
+// FileDiff is the difference of a file between two releases
+type FileDiff struct {
+	Name      string // path of the file, relative to the package directory
+	Status    string // "added", "removed", "modified", "binary" or "too-large"
+	Unified   string // unified diff of the file (for "added", "removed" and "modified" files)
+	Truncated bool   // whether the unified diff was truncated (MaxLines)
+}
+
+// SourceDiff returns the file-level differences of the packages whose tag
+// changed in `r`, locating the packages in the installed releases through
+// the project paths of `r`.
+func SourceDiff(r *TagDiffResult, opts SourceDiffOptions) ([]PackageSourceDiff, error) {
+	if opts.Exclude == nil {
+		opts.Exclude = DefaultSourceExcludes
+	}
+	if opts.Context <= 0 {
+		opts.Context = 3
+	}
+	if opts.MaxFileSize == 0 {
+		opts.MaxFileSize = DefaultMaxSourceSize
+	}
+
+	diffs := make([]PackageSourceDiff, 0)
+	for _, e := range r.Changes() {
+		d := PackageSourceDiff{Entry: e}
+		if e.Kind != Added {
+			d.OldDir = find_package_dir(r.OldProjects, e.Old)
+		}
+		if e.Kind != Removed {
+			d.NewDir = find_package_dir(r.NewProjects, e.New)
+		}
+		if d.OldDir == "" && d.NewDir == "" {
+			return nil, fmt.Errorf("cmt: could not locate package [%s] in any release", e.Name)
+		}
+		err := d.compute(opts)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// WriteTo writes the unified diffs of all the files of the package into `w`
+func (d *PackageSourceDiff) WriteTo(w io.Writer) (int64, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "### %s: %s -> %s\n", d.Entry.Name, or_dash(d.Entry.Old.Version), or_dash(d.Entry.New.Version))
+	for _, f := range d.Files {
+		switch f.Status {
+		case "binary":
+			fmt.Fprintf(buf, "binary files a/%s and b/%s differ\n", f.Name, f.Name)
+		case "too-large":
+			fmt.Fprintf(buf, "files a/%s and b/%s differ: too large, not diffed\n", f.Name, f.Name)
+		default:
+			buf.WriteString(f.Unified)
+		}
+	}
+	if d.Truncated {
+		fmt.Fprintf(buf, "### [diff truncated]\n")
+	}
+	return buf.WriteTo(w)
+}
+
+// compute fills the list of file differences of the package
+func (d *PackageSourceDiff) compute(opts SourceDiffOptions) error {
+	oldfiles, err := list_sources(d.OldDir, opts.Exclude)
+	if err != nil {
+		return err
+	}
+	newfiles, err := list_sources(d.NewDir, opts.Exclude)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(oldfiles)+len(newfiles))
+	for name := range oldfiles {
+		names = append(names, name)
+	}
+	for name := range newfiles {
+		if _, ok := oldfiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	nlines := 0
+	for _, name := range names {
+		if opts.MaxLines > 0 && nlines >= opts.MaxLines {
+			d.Truncated = true
+			break
+		}
+		max := 0
+		if opts.MaxLines > 0 {
+			max = opts.MaxLines - nlines
+		}
+		f, err := diff_file(d.OldDir, d.NewDir, name, oldfiles[name], newfiles[name], opts, max)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			continue
+		}
+		if f.Truncated {
+			d.Truncated = true
+			if f.Unified == "" {
+				// not even the first line of a hunk fits
+				break
+			}
+		}
+		nlines += strings.Count(f.Unified, "\n")
+		d.Files = append(d.Files, *f)
+		if d.Truncated {
+			break
+		}
+	}
+	return nil
+}
+
+// diff_file returns the difference of the file `name` between the two
+// package directories (nil if identical), with a unified diff of at most
+// `max` lines (0: no limit)
+func diff_file(olddir, newdir, name string, oldfi, newfi os.FileInfo, opts SourceDiffOptions, max int) (*FileDiff, error) {
+	f := &FileDiff{Name: name}
+	switch {
+	case oldfi == nil:
+		f.Status = "added"
+	case newfi == nil:
+		f.Status = "removed"
+	default:
+		f.Status = "modified"
+	}
+
+	for _, fi := range []os.FileInfo{oldfi, newfi} {
+		if fi != nil && opts.MaxFileSize > 0 && fi.Size() > opts.MaxFileSize {
+			f.Status = "too-large"
+			return f, nil
+		}
+	}
+
+	var a, b []byte
+	var err error
+	if oldfi != nil {
+		a, err = ioutil.ReadFile(filepath.Join(olddir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if newfi != nil {
+		b, err = ioutil.ReadFile(filepath.Join(newdir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if oldfi != nil && newfi != nil && bytes.Equal(a, b) {
+		return nil, nil
+	}
+	if is_binary(a) || is_binary(b) {
+		f.Status = "binary"
+		return f, nil
+	}
+
+	oldname := "a/" + name
+	newname := "b/" + name
+	if oldfi == nil {
+		oldname = "/dev/null"
+	}
+	if newfi == nil {
+		newname = "/dev/null"
+	}
+	f.Unified, f.Truncated = unified_diff(oldname, newname, split_lines(a), split_lines(b), opts.Context, max)
+	return f, nil
+}
+
+// find_package_dir returns the directory of the package `p` in the first
+// project of `projs` holding it ("" if not found)
+func find_package_dir(projs []ReleaseProject, p Package) string {
+	for _, proj := range projs {
+		if p.Project != "" && short_project_name(proj.Name) != short_project_name(p.Project) {
+			continue
+		}
+		for _, dir := range []string{
+			filepath.Join(proj.Path, filepath.FromSlash(p.Name)),
+			filepath.Join(proj.Path, filepath.FromSlash(p.Name), p.Version),
+		} {
+			if path_exists(filepath.Join(dir, "cmt", "requirements")) {
+				return dir
+			}
+		}
+	}
+	return ""
+}
+
+// list_sources returns the files under `dir`, indexed by their path
+// relative to `dir`, ignoring the ones matching `exclude`
+func list_sources(dir string, exclude []string) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	if dir == "" {
+		return files, nil
+	}
+	err := filepath.Walk(dir, func(fname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fname == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, fname)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pat := range exclude {
+			name := fi.Name()
+			if strings.Contains(pat, "/") {
+				name = rel
+			}
+			ok, _ := path.Match(pat, name)
+			if !ok {
+				continue
+			}
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		files[rel] = fi
+		return nil
+	})
+	return files, err
+}
+
+// is_binary returns whether `data` looks like binary content
+func is_binary(data []byte) bool {
+	n := len(data)
+	if n > 8000 {
+		n = 8000
+	}
+	return bytes.IndexByte(data[:n], 0) != -1
+}
+
+// split_lines splits `data` into lines, keeping the line terminators
+func split_lines(data []byte) []string {
+	lines := make([]string, 0)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			lines = append(lines, string(data)+"\n\\ No newline at end of file\n")
+			break
+		}
+		lines = append(lines, string(data[:i+1]))
+		data = data[i+1:]
+	}
+	return lines
+}
+
+// unified_diff returns the unified diff between the lines `a` and `b`,
+// with `n` lines of context.
+// The diff is cut after `max` lines (0: no limit), at the end of a hunk
+// line, and is then reported as truncated. It is empty if not even the
+// first line of a hunk fits.
+func unified_diff(aname, bname string, a, b []string, n, max int) (string, bool) {
+	ops := diff_lines(a, b)
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", aname, bname)
+	nlines := 2
+
+	// group the changes, with their context, into hunks
+	type span struct{ beg, end int }
+	hunks := make([]span, 0)
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		beg := i - n
+		if beg < 0 {
+			beg = 0
+		}
+		end := i + n + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if k := len(hunks) - 1; k >= 0 && beg <= hunks[k].end {
+			hunks[k].end = end
+			continue
+		}
+		hunks = append(hunks, span{beg, end})
+	}
+
+	truncated := false
+	for _, h := range hunks {
+		astart, bstart := ops[h.beg].a, ops[h.beg].b
+		alen, blen := 0, 0
+		hunk := new(bytes.Buffer)
+		hlines := 1 // the hunk header
+		for _, op := range ops[h.beg:h.end] {
+			var line string
+			switch op.kind {
+			case ' ':
+				line = " " + a[op.a]
+			case '-':
+				line = "-" + a[op.a]
+			case '+':
+				line = "+" + b[op.b]
+			}
+			nl := strings.Count(line, "\n")
+			if max > 0 && nlines+hlines+nl > max {
+				truncated = true
+				break
+			}
+			switch op.kind {
+			case ' ':
+				alen++
+				blen++
+			case '-':
+				alen++
+			case '+':
+				blen++
+			}
+			hlines += nl
+			hunk.WriteString(line)
+		}
+		if hunk.Len() == 0 {
+			break
+		}
+		// the header describes the lines actually written
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunk_range(astart, alen), hunk_range(bstart, blen))
+		hunk.WriteTo(buf)
+		nlines += hlines
+		if truncated {
+			break
+		}
+	}
+	if truncated && nlines == 2 {
+		return "", true
+	}
+	return buf.String(), truncated
+}
+
+func hunk_range(start, n int) string {
+	if n == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if n == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// diffOp is an operation of an edit script: keep (' '), delete ('-') or
+// insert ('+') a line. a and b are the indices of the line in each input
+// (or of the next line, for lines absent from that input).
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// diff_lines returns the edit script turning `a` into `b`, computed with
+// the linear space variant of Myers' O(ND) algorithm
+func diff_lines(a, b []string) []diffOp {
+	return diff_rec(a, b, 0, 0, make([]diffOp, 0, len(a)+len(b)))
+}
+
+// diff_rec appends to `ops` the edit script turning `a` into `b`, which
+// start at the lines `ao` and `bo` of the whole inputs
+func diff_rec(a, b []string, ao, bo int, ops []diffOp) []diffOp {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		ops = append(ops, diffOp{' ', ao, bo})
+		a, b = a[1:], b[1:]
+		ao++
+		bo++
+	}
+	suf := 0
+	for suf < len(a) && suf < len(b) && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[:len(a)-suf], b[:len(b)-suf]
+
+	switch {
+	case len(a) == 0:
+		for j := range b {
+			ops = append(ops, diffOp{'+', ao, bo + j})
+		}
+	case len(b) == 0:
+		for i := range a {
+			ops = append(ops, diffOp{'-', ao + i, bo})
+		}
+	default:
+		// both ends differ, so the edit distance is at least 2 and both
+		// halves around the middle snake are smaller problems
+		x, y, u, v := middle_snake(a, b)
+		ops = diff_rec(a[:x], b[:y], ao, bo, ops)
+		for k := 0; k < u-x; k++ {
+			ops = append(ops, diffOp{' ', ao + x + k, bo + y + k})
+		}
+		ops = diff_rec(a[u:], b[v:], ao+u, bo+v, ops)
+	}
+
+	for k := 0; k < suf; k++ {
+		ops = append(ops, diffOp{' ', ao + len(a) + k, bo + len(b) + k})
+	}
+	return ops
+}
+
+// middle_snake returns the start (x,y) and end (u,v) of the middle snake
+// of an optimal edit path between `a` and `b`, searching forward from the
+// start and backward from the end until the two searches overlap
+func middle_snake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	delta := n - m
+	odd := delta%2 != 0
+	off := max + 1
+	vf := make([]int, 2*max+3) // furthest x reached forward, by diagonal x-y
+	vb := make([]int, 2*max+3) // furthest x reached backward from (n,m), by diagonal (n-x)-(m-y)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			x := vf[off+k-1] + 1
+			if k == -d || (k != d && vf[off+k-1] < vf[off+k+1]) {
+				x = vf[off+k+1]
+			}
+			y := x - k
+			x0, y0 := x, y
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			vf[off+k] = x
+			if kr := delta - k; odd && kr >= -(d-1) && kr <= d-1 && x+vb[off+kr] >= n {
+				return x0, y0, x, y
+			}
+		}
+		for kr := -d; kr <= d; kr += 2 {
+			x := vb[off+kr-1] + 1
+			if kr == -d || (kr != d && vb[off+kr-1] < vb[off+kr+1]) {
+				x = vb[off+kr+1]
+			}
+			y := x - kr
+			x0, y0 := x, y
+			for x < n && y < m && a[n-1-x] == b[m-1-y] {
+				x++
+				y++
+			}
+			vb[off+kr] = x
+			if k := delta - kr; !odd && k >= -d && k <= d && x+vf[off+k] >= n {
+				return n - x, m - y, n - x0, m - y0
+			}
+		}
+	}
+	// not reached: the searches overlap after at most max steps
+	return 0, 0, n, m
+}
+
+// EOF
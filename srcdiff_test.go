@@ -0,0 +1,80 @@
+package cmt
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourceDiffMaxLines(t *testing.T) {
+	top := t.TempDir()
+	olddir := filepath.Join(top, "old", "Control", "AthenaKernel")
+	newdir := filepath.Join(top, "new", "Control", "AthenaKernel")
+	var a, b strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&a, "line %d\n", i)
+		fmt.Fprintf(&b, "line %d (new)\n", i)
+	}
+	for _, name := range []string{"src/A.cxx", "src/B.cxx"} {
+		write_file(t, filepath.Join(olddir, filepath.FromSlash(name)), a.String())
+		write_file(t, filepath.Join(newdir, filepath.FromSlash(name)), b.String())
+	}
+
+	for _, tc := range []struct {
+		max       int
+		files     int
+		truncated bool
+	}{
+		{0, 2, false},
+		{2, 0, true},
+		{3, 0, true},
+		{4, 1, true},
+		{40, 1, true},
+		{103, 1, true},
+		{110, 2, true},
+		{206, 2, false},
+	} {
+		d := PackageSourceDiff{OldDir: olddir, NewDir: newdir}
+		err := d.compute(SourceDiffOptions{
+			Exclude:  DefaultSourceExcludes,
+			Context:  3,
+			MaxLines: tc.max,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(d.Files) != tc.files || d.Truncated != tc.truncated {
+			t.Errorf("max=%d: got %d files (truncated=%v), want %d (truncated=%v)",
+				tc.max, len(d.Files), d.Truncated, tc.files, tc.truncated)
+			continue
+		}
+		nlines := 0
+		for _, f := range d.Files {
+			nlines += strings.Count(f.Unified, "\n")
+			if f.Truncated && !strings.HasPrefix(f.Unified, "--- a/"+f.Name) {
+				t.Errorf("max=%d: invalid truncated diff of %s:\n%s", tc.max, f.Name, f.Unified)
+			}
+		}
+		if tc.max > 0 && nlines > tc.max {
+			t.Errorf("max=%d: got %d lines", tc.max, nlines)
+		}
+		var out strings.Builder
+		d.WriteTo(&out)
+		if got := strings.Contains(out.String(), "[diff truncated]"); got != tc.truncated {
+			t.Errorf("max=%d: truncation marker: got %v, want %v", tc.max, got, tc.truncated)
+		}
+	}
+}
+
+func TestUnifiedDiffTruncatedHunk(t *testing.T) {
+	a := []string{"a\n", "b\n", "c\n", "d\n"}
+	b := []string{"A\n", "B\n", "C\n", "D\n"}
+	got, truncated := unified_diff("a/f", "b/f", a, b, 3, 6)
+	want := "--- a/f\n+++ b/f\n@@ -1,3 +0,0 @@\n-a\n-b\n-c\n"
+	if got != want || !truncated {
+		t.Fatalf("got (truncated=%v):\n%s\nwant:\n%s", truncated, got, want)
+	}
+}
+
+// EOF
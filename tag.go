@@ -0,0 +1,331 @@
+package cmt
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TagLevel identifies a component of a tag
+type TagLevel int
+
+const (
+	NoLevel     TagLevel = iota // no component (identical tags)
+	MajorLevel                  // XX in Pkg-XX-YY-ZZ
+	MinorLevel                  // YY in Pkg-XX-YY-ZZ
+	PatchLevel                  // ZZ in Pkg-XX-YY-ZZ
+	BranchLevel                 // WW in Pkg-XX-YY-ZZ-WW
+	OtherLevel                  // package name, branch flag or suffix
+)
+
+func (lvl TagLevel) String() string {
+	switch lvl {
+	case NoLevel:
+		return "none"
+	case MajorLevel:
+		return "major"
+	case MinorLevel:
+		return "minor"
+	case PatchLevel:
+		return "patch"
+	case BranchLevel:
+		return "branch"
+	case OtherLevel:
+		return "other"
+	}
+	return fmt.Sprintf("TagLevel(%d)", int(lvl))
+}
+
+// Tag is a package tag following the ATLAS convention PkgName-XX-YY-ZZ[-WW],
+// a branch tag (PkgName-XX-YY-ZZ-branch), possibly with a suffix
+// (e.g. PkgName-XX-YY-ZZ-r612345), or a CMT-style version (v1r2p3).
+type Tag struct {
+	Package string // package basename ("" for CMT-style versions and bare numbers)
+	Nums    []int  // numeric components: major, minor, patch[, branch]
+	Branch  bool   // whether this is a branch tag (...-branch)
+	Suffix  string // trailing non-numeric component (e.g. "r612345")
+	CMT     bool   // whether this is a CMT-style version (v1r2p3)
+}
+
+var re_cmt_version = regexp.MustCompile(`^v(\d+)(?:r(\d+)(?:p(\d+))?)?$`)
+
+// ParseTag parses a tag, e.g. "AthenaKernel-01-02-03", "AthenaKernel-01-02-03-04",
+// "AthenaKernel-01-02-03-branch", "01-02-03" or "v1r2p3".
+func ParseTag(s string) (Tag, error) {
+	var t Tag
+	s = strings.Trim(s, " /\r\n\t")
+	if m := re_cmt_version.FindStringSubmatch(s); m != nil {
+		t.CMT = true
+		for _, v := range m[1:] {
+			if v == "" {
+				break
+			}
+			n, _ := strconv.Atoi(v)
+			t.Nums = append(t.Nums, n)
+		}
+		return t, nil
+	}
+
+	toks := strings.Split(s, "-")
+	end := len(toks)
+	if end > 0 && !is_digits(toks[end-1]) {
+		switch last := toks[end-1]; last {
+		case "branch":
+			t.Branch = true
+		default:
+			t.Suffix = last
+		}
+		end--
+	}
+	beg := end
+	for beg > 0 && end-beg < 4 && is_digits(toks[beg-1]) {
+		beg--
+	}
+	if end-beg < 3 {
+		return Tag{}, fmt.Errorf("cmt: invalid tag [%s] (expected PkgName-XX-YY-ZZ[-WW])", s)
+	}
+	// the first components of 5-numbers tags belong to the package name
+	t.Package = strings.Join(toks[:beg], "-")
+	for _, tok := range toks[beg:end] {
+		n, _ := strconv.Atoi(tok)
+		t.Nums = append(t.Nums, n)
+	}
+	if t.Branch && len(t.Nums) != 3 {
+		return Tag{}, fmt.Errorf("cmt: invalid branch tag [%s] (expected PkgName-XX-YY-ZZ-branch)", s)
+	}
+	return t, nil
+}
+
+// MustParseTag is like ParseTag but panics on invalid tags
+func MustParseTag(s string) Tag {
+	t, err := ParseTag(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the tag in its canonical form
+func (t Tag) String() string {
+	if t.CMT {
+		o := ""
+		for i, n := range t.Nums {
+			o += fmt.Sprintf("%c%d", "vrp"[i], n)
+		}
+		return o
+	}
+	o := t.Short()
+	if t.Package != "" {
+		o = t.Package + "-" + o
+	}
+	return o
+}
+
+// Short returns the tag without the package name (e.g. "01-02-03")
+func (t Tag) Short() string {
+	if t.CMT {
+		return t.String()
+	}
+	toks := make([]string, 0, len(t.Nums)+1)
+	for _, n := range t.Nums {
+		toks = append(toks, fmt.Sprintf("%02d", n))
+	}
+	switch {
+	case t.Branch:
+		toks = append(toks, "branch")
+	case t.Suffix != "":
+		toks = append(toks, t.Suffix)
+	}
+	return strings.Join(toks, "-")
+}
+
+func (t Tag) num(i int) int {
+	if i < len(t.Nums) {
+		return t.Nums[i]
+	}
+	return 0
+}
+
+// Major returns the major component of the tag
+func (t Tag) Major() int { return t.num(0) }
+
+// Minor returns the minor component of the tag
+func (t Tag) Minor() int { return t.num(1) }
+
+// Patch returns the patch component of the tag
+func (t Tag) Patch() int { return t.num(2) }
+
+// Compare compares the tags `t` and `o` and returns -1, 0 or +1.
+// Tags are ordered by package name, then by numeric components (with
+// XX-YY-ZZ < XX-YY-ZZ-WW), then plain < suffixed < branch tags.
+func (t Tag) Compare(o Tag) int {
+	if c := strings.Compare(t.Package, o.Package); c != 0 {
+		return c
+	}
+	if t.CMT != o.CMT {
+		if t.CMT {
+			return -1
+		}
+		return +1
+	}
+	for i := 0; i < len(t.Nums) && i < len(o.Nums); i++ {
+		if t.Nums[i] != o.Nums[i] {
+			return sign(t.Nums[i] - o.Nums[i])
+		}
+	}
+	if len(t.Nums) != len(o.Nums) {
+		return sign(len(t.Nums) - len(o.Nums))
+	}
+	if t.Branch != o.Branch {
+		if t.Branch {
+			return +1
+		}
+		return -1
+	}
+	return compare_suffixes(t.Suffix, o.Suffix)
+}
+
+// Less returns whether `t` sorts before `o`
+func (t Tag) Less(o Tag) bool {
+	return t.Compare(o) < 0
+}
+
+// Equal returns whether `t` and `o` are the same tag
+func (t Tag) Equal(o Tag) bool {
+	return t.Compare(o) == 0
+}
+
+// Changed returns the most significant component which differs between
+// the tags `t` and `o`
+func (t Tag) Changed(o Tag) TagLevel {
+	if t.Package != o.Package || t.CMT != o.CMT {
+		return OtherLevel
+	}
+	n := len(t.Nums)
+	if len(o.Nums) > n {
+		n = len(o.Nums)
+	}
+	for i := 0; i < n; i++ {
+		if t.num(i) != o.num(i) || (i >= len(t.Nums)) != (i >= len(o.Nums)) {
+			if i > 3 {
+				return OtherLevel
+			}
+			return TagLevel(i + 1)
+		}
+	}
+	if t.Branch != o.Branch || t.Suffix != o.Suffix {
+		return OtherLevel
+	}
+	return NoLevel
+}
+
+// Bump returns the next tag after `t` for the given level: bumping a
+// component resets the less significant ones (bumping MinorLevel of
+// Pkg-01-02-03 gives Pkg-01-03-00), and BranchLevel bumps or adds the
+// 4th component (Pkg-01-02-03-branch gives Pkg-01-02-03-01).
+func (t Tag) Bump(lvl TagLevel) (Tag, error) {
+	if lvl < MajorLevel || lvl > BranchLevel {
+		return Tag{}, fmt.Errorf("cmt: invalid bump level [%v]", lvl)
+	}
+	if t.CMT && lvl == BranchLevel {
+		return Tag{}, fmt.Errorf("cmt: CMT-style versions have no branch component")
+	}
+	i := int(lvl) - 1
+	n := 3
+	if lvl == BranchLevel {
+		n = 4
+	}
+	nums := make([]int, n)
+	copy(nums, t.Nums)
+	nums[i]++
+	for j := i + 1; j < n; j++ {
+		nums[j] = 0
+	}
+	if t.CMT {
+		nums = nums[:len(t.Nums)]
+		if i >= len(nums) {
+			nums = append(nums, make([]int, i+1-len(nums))...)
+			nums[i] = 1
+		}
+	}
+	return Tag{Package: t.Package, Nums: nums, CMT: t.CMT}, nil
+}
+
+// BelongsTo returns whether the tag is a tag of the package `pkg`
+// (full name or basename)
+func (t Tag) BelongsTo(pkg string) bool {
+	if t.CMT || t.Package == "" {
+		return false
+	}
+	return t.Package == pkg_basename(pkg)
+}
+
+// Validate checks that the tag follows the ATLAS convention for the package `pkg`
+func (t Tag) Validate(pkg string) error {
+	if !t.BelongsTo(pkg) {
+		return fmt.Errorf("cmt: tag [%s] does not belong to package [%s]", t, pkg)
+	}
+	if len(t.Nums) < 3 || len(t.Nums) > 4 {
+		return fmt.Errorf("cmt: tag [%s] does not follow the PkgName-XX-YY-ZZ[-WW] convention", t)
+	}
+	return nil
+}
+
+// Tag returns the parsed version of the package
+func (p *Package) Tag() (Tag, error) {
+	return ParseTag(p.Version)
+}
+
+// pkg_basename returns the basename of a package full name
+func pkg_basename(pkg string) string {
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		return pkg[i+1:]
+	}
+	return pkg
+}
+
+// is_digits returns whether `s` is a non-empty string of decimal digits
+func is_digits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// compare_suffixes compares tag suffixes, numerically when they are of
+// the form <letters><digits> with the same letters (e.g. r9 < r10)
+func compare_suffixes(a, b string) int {
+	if a == b {
+		return 0
+	}
+	ia := strings.IndexAny(a, "0123456789")
+	ib := strings.IndexAny(b, "0123456789")
+	if ia > 0 && ib > 0 && a[:ia] == b[:ib] && is_digits(a[ia:]) && is_digits(b[ib:]) {
+		na, _ := strconv.Atoi(a[ia:])
+		nb, _ := strconv.Atoi(b[ib:])
+		if na != nb {
+			return sign(na - nb)
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+// compare_versions compares the versions `a` and `b`, as tags when they
+// follow the ATLAS convention and as strings otherwise.
+// It returns -1, 0 or +1.
+func compare_versions(a, b string) int {
+	ta, erra := ParseTag(a)
+	tb, errb := ParseTag(b)
+	if erra != nil || errb != nil {
+		return strings.Compare(a, b)
+	}
+	return ta.Compare(tb)
+}
+
+// EOF
@@ -0,0 +1,198 @@
+package cmt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTag(t *testing.T) {
+	for _, tc := range []struct {
+		tag  string
+		want Tag
+		str  string // canonical form ("": same as tag)
+	}{
+		{"AthenaKernel-01-02-03", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 3}}, ""},
+		{"AthenaKernel-01-02-03-04", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 3, 4}}, ""},
+		{"AthenaKernel-01-02-03-branch", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 3}, Branch: true}, ""},
+		{"AthenaKernel-01-02-03-r612345", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 3}, Suffix: "r612345"}, ""},
+		{"AthenaKernel-1-2-3", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 3}}, "AthenaKernel-01-02-03"},
+		{"AthenaKernel-01-02-123", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 123}}, ""},
+		{"Foo-Bar-01-02-03", Tag{Package: "Foo-Bar", Nums: []int{1, 2, 3}}, ""},
+		{"Pkg-5-01-02-03-04", Tag{Package: "Pkg-5", Nums: []int{1, 2, 3, 4}}, ""},
+		{" AthenaKernel-01-02-03/\n", Tag{Package: "AthenaKernel", Nums: []int{1, 2, 3}}, "AthenaKernel-01-02-03"},
+		{"01-02-03", Tag{Nums: []int{1, 2, 3}}, ""},
+		{"v1r2p3", Tag{Nums: []int{1, 2, 3}, CMT: true}, ""},
+		{"v1r2", Tag{Nums: []int{1, 2}, CMT: true}, ""},
+		{"v1", Tag{Nums: []int{1}, CMT: true}, ""},
+	} {
+		got, err := ParseTag(tc.tag)
+		if err != nil {
+			t.Errorf("ParseTag(%q): %v", tc.tag, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ParseTag(%q):\ngot:  %+v\nwant: %+v", tc.tag, got, tc.want)
+		}
+		str := tc.str
+		if str == "" {
+			str = tc.tag
+		}
+		if got.String() != str {
+			t.Errorf("ParseTag(%q).String() = %q, want %q", tc.tag, got.String(), str)
+		}
+	}
+
+	for _, tag := range []string{
+		"",
+		"trunk",
+		"AthenaKernel",
+		"AthenaKernel-01-02",
+		"AthenaKernel-01-02-branch",
+		"AthenaKernel-01-02-03-04-branch",
+		"AthenaKernel-01-xx-03",
+		"v1p3",
+	} {
+		_, err := ParseTag(tag)
+		if err == nil {
+			t.Errorf("ParseTag(%q): expected an error", tag)
+		}
+	}
+}
+
+func TestTagCompare(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"Pkg-01-02-03", "Pkg-01-02-03", 0},
+		{"Pkg-01-02-03", "Pkg-1-2-3", 0},
+		{"Pkg-01-02-03", "Pkg-01-02-04", -1},
+		{"Pkg-02-00-00", "Pkg-01-99-99", +1},
+		{"Pkg-01-10-00", "Pkg-01-09-00", +1},
+		{"Pkg-01-02-03", "Pkg-01-02-03-01", -1},
+		{"Pkg-01-02-03-02", "Pkg-01-02-03-01", +1},
+		{"Pkg-01-02-03-01", "Pkg-01-02-04", -1},
+		{"Pkg-01-02-03", "Pkg-01-02-03-r1", -1},
+		{"Pkg-01-02-03-r9", "Pkg-01-02-03-r10", -1},
+		{"Pkg-01-02-03-r1", "Pkg-01-02-03-branch", -1},
+		{"Pkg-01-02-03-branch", "Pkg-01-02-04", -1},
+		{"Pkg-01-02-03-branch", "Pkg-01-02-03", +1},
+		{"Apkg-09-00-00", "Bpkg-01-00-00", -1},
+		{"v1r2", "v1r10", -1},
+		{"v1r2p3", "v1r2", +1},
+		{"01-02-03", "v1r2p3", +1},
+	} {
+		a := MustParseTag(tc.a)
+		b := MustParseTag(tc.b)
+		if got := a.Compare(b); got != tc.want {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := b.Compare(a); got != -tc.want {
+			t.Errorf("Compare(%s, %s) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+		if a.Less(b) != (tc.want < 0) || a.Equal(b) != (tc.want == 0) {
+			t.Errorf("Less/Equal(%s, %s) inconsistent with Compare", tc.a, tc.b)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"Pkg-01-02-10", "Pkg-01-02-09", +1},
+		{"trunk", "trunk", 0},
+		{"trunk", "Pkg-01-02-03", +1},
+		{"Pkg-01-02-03", "trunk", -1},
+	} {
+		if got := compare_versions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compare_versions(%s, %s) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestTagChanged(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want TagLevel
+	}{
+		{"Pkg-01-02-03", "Pkg-01-02-03", NoLevel},
+		{"Pkg-01-02-03", "Pkg-02-02-03", MajorLevel},
+		{"Pkg-01-02-03", "Pkg-01-03-03", MinorLevel},
+		{"Pkg-01-02-03", "Pkg-01-02-04", PatchLevel},
+		{"Pkg-01-02-03", "Pkg-01-02-03-01", BranchLevel},
+		{"Pkg-01-02-03-01", "Pkg-01-02-03-02", BranchLevel},
+		{"Pkg-01-02-03", "Pkg-01-02-03-branch", OtherLevel},
+		{"Pkg-01-02-03", "Pkg-01-02-03-r1", OtherLevel},
+		{"Pkg-01-02-03", "Other-01-02-03", OtherLevel},
+		{"Pkg-01-02-03", "Pkg-02-03-04", MajorLevel},
+	} {
+		got := MustParseTag(tc.a).Changed(MustParseTag(tc.b))
+		if got != tc.want {
+			t.Errorf("Changed(%s, %s) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestTagBump(t *testing.T) {
+	for _, tc := range []struct {
+		tag  string
+		lvl  TagLevel
+		want string // "": error
+	}{
+		{"Pkg-01-02-03", MajorLevel, "Pkg-02-00-00"},
+		{"Pkg-01-02-03", MinorLevel, "Pkg-01-03-00"},
+		{"Pkg-01-02-03", PatchLevel, "Pkg-01-02-04"},
+		{"Pkg-01-02-03", BranchLevel, "Pkg-01-02-03-01"},
+		{"Pkg-01-02-99", PatchLevel, "Pkg-01-02-100"},
+		{"Pkg-01-02-03-04", PatchLevel, "Pkg-01-02-04"},
+		{"Pkg-01-02-03-04", BranchLevel, "Pkg-01-02-03-05"},
+		{"Pkg-01-02-03-branch", BranchLevel, "Pkg-01-02-03-01"},
+		{"Pkg-01-02-03-branch", PatchLevel, "Pkg-01-02-04"},
+		{"Pkg-01-02-03-r5", PatchLevel, "Pkg-01-02-04"},
+		{"01-02-03", MinorLevel, "01-03-00"},
+		{"v1r2p3", MinorLevel, "v1r3p0"},
+		{"v1r2", PatchLevel, "v1r2p1"},
+		{"v1r2", MajorLevel, "v2r0"},
+		{"v1", MinorLevel, "v1r1"},
+		{"v1r2p3", BranchLevel, ""},
+		{"Pkg-01-02-03", NoLevel, ""},
+		{"Pkg-01-02-03", OtherLevel, ""},
+	} {
+		got, err := MustParseTag(tc.tag).Bump(tc.lvl)
+		switch {
+		case tc.want == "" && err == nil:
+			t.Errorf("Bump(%s, %v): expected an error, got %s", tc.tag, tc.lvl, got)
+		case tc.want != "" && err != nil:
+			t.Errorf("Bump(%s, %v): %v", tc.tag, tc.lvl, err)
+		case tc.want != "" && got.String() != tc.want:
+			t.Errorf("Bump(%s, %v) = %s, want %s", tc.tag, tc.lvl, got, tc.want)
+		}
+	}
+}
+
+func TestTagValidate(t *testing.T) {
+	for _, tc := range []struct {
+		tag string
+		pkg string
+		ok  bool
+	}{
+		{"AthenaKernel-01-02-03", "Control/AthenaKernel", true},
+		{"AthenaKernel-01-02-03", "AthenaKernel", true},
+		{"AthenaKernel-01-02-03-04", "Control/AthenaKernel", true},
+		{"AthenaKernel-01-02-03-branch", "Control/AthenaKernel", true},
+		{"Pkg-5-01-02-03-04", "Tools/Pkg-5", true},
+		{"AthenaKernel-01-02-03", "Control/StoreGate", false},
+		{"AthenaKernel-01-02-03", "Control/Athena", false},
+		{"01-02-03", "Control/AthenaKernel", false},
+		{"v1r2p3", "Control/AthenaKernel", false},
+	} {
+		err := MustParseTag(tc.tag).Validate(tc.pkg)
+		if (err == nil) != tc.ok {
+			t.Errorf("Validate(%s, %s) = %v, want ok=%v", tc.tag, tc.pkg, err, tc.ok)
+		}
+	}
+}
+
+// EOF
@@ -2,154 +2,272 @@ package cmt
 
 import (
 	"fmt"
-	"path/filepath"
+	"os"
 	"sort"
-	"strings"
 )
 
-// TagDiff returns the list of tag differences between 2 releases/nightlies
-func TagDiff(old, new string, display, verbose bool) (map[string]map[string]Package, error) {
-	var err error
-	diffs := make(map[string]map[string]Package)
+// ChangeKind classifies the difference of a package between two releases
+type ChangeKind int
+
+const (
+	Unchanged      ChangeKind = iota // same version, same project
+	Added                            // package only in the new release
+	Removed                          // package only in the old release
+	VersionChanged                   // different version, same project
+	Moved                            // package moved to another project (version may differ too)
+)
+
+// ChangeKinds lists all the kinds of changes, in display order
+var ChangeKinds = []ChangeKind{Added, Removed, VersionChanged, Moved, Unchanged}
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Unchanged:
+		return "unchanged"
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case VersionChanged:
+		return "changed"
+	case Moved:
+		return "moved"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", int(k))
+}
 
-	cmts := map[string]*Cmt{
-		"old": nil,
-		"new": nil,
-	}
-	tags := map[string]string{
-		"old": old,
-		"new": new,
-	}
-
-	type response struct {
-		name string
-		cmt  *Cmt
-		err  error
-	}
-
-	ch := make(chan response)
-	defer close(ch)
-
-	for name, tag := range tags {
-		go func(tag, name string, ch chan response) {
-			if display {
-				fmt.Printf("::: setup %s env. [%s]...\n", name, tag)
-			}
-			env, err := NewSetup(tag, verbose)
-			if err != nil {
-				ch <- response{name, nil, err}
-				return
-			}
-			cmt, err := New(env)
-			if err != nil {
-				ch <- response{name, nil, err}
-				return
-			}
-			ch <- response{name, cmt, nil}
-		}(tag, name, ch)
-	}
-
-	for _ = range cmts {
-		r := <-ch
-		if r.err != nil {
-			fmt.Printf("**error** setup of [%s] failed: %v\n", r.name, r.err)
-			return nil, r.err
+// ReleaseProject describes a project of a release
+type ReleaseProject struct {
+	Name    string `json:"name"`    // name of the project (e.g. AtlasCore)
+	Version string `json:"version"` // version of the project
+	Path    string `json:"path"`    // path to where the project is installed
+}
+
+// TagDiffEntry is the difference of a package between two releases
+type TagDiffEntry struct {
+	Name string     // package full name
+	Kind ChangeKind // kind of change
+	Old  Package    // package in the old release (zero if Added)
+	New  Package    // package in the new release (zero if Removed)
+
+	Order    int  // ordering of the new version w.r.t. the old one (-1, 0 or +1)
+	Modified bool // whether the new package has uncommitted changes (TestArea diffs)
+}
+
+// TagDiffResult holds the tag differences between two releases
+type TagDiffResult struct {
+	Old         string           // identifier of the old release (e.g. asetup tags)
+	New         string           // identifier of the new release
+	OldProjects []ReleaseProject // projects of the old release
+	NewProjects []ReleaseProject // projects of the new release
+	Entries     []TagDiffEntry   // packages, sorted by name
+}
+
+// Changes returns the entries which are not Unchanged
+func (r *TagDiffResult) Changes() []TagDiffEntry {
+	out := make([]TagDiffEntry, 0, len(r.Entries))
+	for _, e := range r.Entries {
+		if e.Kind != Unchanged {
+			out = append(out, e)
 		}
-		cmts[r.name] = r.cmt
 	}
+	return out
+}
 
-	pkgs := map[string]map[string]Package{
-		"old": make(map[string]Package),
-		"new": make(map[string]Package),
+// CountByKind returns the number of entries per kind of change
+func (r *TagDiffResult) CountByKind() map[ChangeKind]int {
+	counts := make(map[ChangeKind]int)
+	for _, e := range r.Entries {
+		counts[e.Kind]++
 	}
+	return counts
+}
 
-	for k := range cmts {
-		cmt := cmts[k]
-		dag, err := cmt.ProjectsDag()
-		if err != nil {
-			return nil, err
-		}
-		for _, proj := range dag {
-			dirnames, err := filepath.Glob(filepath.Join(proj.Path, "*Release"))
-			if err != nil {
-				return diffs, err
-			}
-			if len(dirnames) != 1 {
-				continue
-			}
-			reldata := filepath.Join(dirnames[0], "cmt", "requirements")
-			uses, err := extract_uses(reldata, cmt.msg)
-			if err != nil {
-				return diffs, err
-			}
-			projname := proj.Name
-			if strings.HasPrefix(projname, "Atlas") {
-				projname = projname[len("Atlas"):]
-			}
-			for _, use := range uses {
-				use.Project = projname
-				pkgs[k][use.Name] = use
-			}
+// CountByProject returns the number of entries per project and kind of change.
+// Entries are counted under the project of the new release, or of the old
+// release for removed packages.
+func (r *TagDiffResult) CountByProject() map[string]map[ChangeKind]int {
+	counts := make(map[string]map[ChangeKind]int)
+	for _, e := range r.Entries {
+		proj := e.Project()
+		if counts[proj] == nil {
+			counts[proj] = make(map[ChangeKind]int)
 		}
+		counts[proj][e.Kind]++
 	}
+	return counts
+}
 
-	cmp_diffs := func(a, b string) {
-		for pname := range pkgs[a] {
-			p_a := pkgs[a][pname]
-			p_b, ok := pkgs[b][pname]
-			if !ok {
-				diffs[pname] = map[string]Package{
-					a: p_a,
-					b: {"None", "None-00-00-00", p_a.Project},
-				}
-				continue
-			}
-			if p_b.Version != p_a.Version {
-				diffs[pname] = map[string]Package{
-					a: p_a,
-					b: p_b,
-				}
-				continue
-			}
-		}
+// Ahead returns whether the new version is more recent than the old one
+func (e *TagDiffEntry) Ahead() bool {
+	return e.Order > 0
+}
 
+// Behind returns whether the new version is older than the old one
+func (e *TagDiffEntry) Behind() bool {
+	return e.Order < 0
+}
+
+// Level returns the most significant tag component which changed between
+// the old and new versions (OtherLevel if they can not be parsed as tags)
+func (e *TagDiffEntry) Level() TagLevel {
+	if e.Kind == Added || e.Kind == Removed {
+		return OtherLevel
+	}
+	t_old, err := e.Old.Tag()
+	if err != nil {
+		return OtherLevel
+	}
+	t_new, err := e.New.Tag()
+	if err != nil {
+		return OtherLevel
 	}
-	cmp_diffs("old", "new")
-	cmp_diffs("new", "old")
+	return t_old.Changed(t_new)
+}
 
-	if len(diffs) == 0 {
-		return nil, nil
+// Project returns the project the entry belongs to: the project of the
+// new package, or of the old one if the package was removed
+func (e *TagDiffEntry) Project() string {
+	if e.Kind == Removed {
+		return e.Old.Project
 	}
+	return e.New.Project
+}
 
-	if !display {
-		return diffs, err
+// TagDiffOptions configures the computation of tag differences
+type TagDiffOptions struct {
+	Unchanged bool           // whether to report unchanged packages too
+	Verbose   bool           // whether to setup the environments in verbose mode
+	Display   bool           // whether to print progress messages
+	Filter    *TagDiffFilter // packages to report (nil: all)
+}
+
+// DiffReleases returns the tag differences between the releases `old` and
+// `new`, each given either as asetup tags (e.g. "rel_1,devval") or as the
+// path to a release manifest file.
+// Environments are set up in parallel, as needed.
+func DiffReleases(old, new string, opts TagDiffOptions) (*TagDiffResult, error) {
+	ms, err := load_releases([]string{old, new}, 2, opts)
+	if err != nil {
+		return nil, err
 	}
+	return DiffManifests(ms[0], ms[1], opts), nil
+}
 
-	format := "%-15s %-15s | %-15s %-15s | %-45s\n"
-	fmt.Printf(format, "old", "old-proj", "new", "new-project", "pkg-name")
-	fmt.Printf(strings.Repeat("-", 120) + "\n")
+// DiffManifests returns the tag differences between two release manifests
+func DiffManifests(old, new *Manifest, opts TagDiffOptions) *TagDiffResult {
+	return diff_packages(
+		old.Release, new.Release,
+		old.ReleaseProjects(), new.ReleaseProjects(),
+		old.Packages(), new.Packages(),
+		opts,
+	)
+}
 
-	keys := make([]string, 0, len(diffs))
-	for pname := range diffs {
-		keys = append(keys, pname)
+// diff_packages classifies the differences between two sets of packages
+func diff_packages(old, new string, oldprojs, newprojs []ReleaseProject, oldpkgs, newpkgs map[string]Package, opts TagDiffOptions) *TagDiffResult {
+	r := &TagDiffResult{
+		Old:         old,
+		New:         new,
+		OldProjects: oldprojs,
+		NewProjects: newprojs,
+		Entries:     make([]TagDiffEntry, 0),
 	}
-	sort.Strings(keys)
 
-	for _, pname := range keys {
-		diff := diffs[pname]
-		p_old := diff["old"]
-		p_new := diff["new"]
-		v_old := strings.Replace(p_old.Version, p_old.Base()+"-", "", -1)
-		v_new := strings.Replace(p_new.Version, p_new.Base()+"-", "", -1)
+	for name, p_old := range oldpkgs {
+		p_new, ok := newpkgs[name]
+		e := TagDiffEntry{Name: name, Old: p_old, New: p_new}
+		switch {
+		case !ok:
+			e.Kind = Removed
+		case p_old.Project != p_new.Project:
+			e.Kind = Moved
+		case p_old.Version != p_new.Version:
+			e.Kind = VersionChanged
+		default:
+			e.Kind = Unchanged
+		}
+		if ok {
+			e.Order = compare_versions(p_new.Version, p_old.Version)
+		}
+		if e.Kind == Unchanged && !opts.Unchanged {
+			continue
+		}
+		if !opts.Filter.Match(e) {
+			continue
+		}
+		r.Entries = append(r.Entries, e)
+	}
+	for name, p_new := range newpkgs {
+		if _, ok := oldpkgs[name]; ok {
+			continue
+		}
+		e := TagDiffEntry{Name: name, Kind: Added, New: p_new}
+		if !opts.Filter.Match(e) {
+			continue
+		}
+		r.Entries = append(r.Entries, e)
+	}
+
+	sort.Sort(tagDiffEntries(r.Entries))
+	return r
+}
+
+type tagDiffEntries []TagDiffEntry
 
-		fmt.Printf(format,
-			v_old, p_old.Project,
-			v_new, p_new.Project,
-			pname,
-		)
+func (p tagDiffEntries) Len() int           { return len(p) }
+func (p tagDiffEntries) Less(i, j int) bool { return p[i].Name < p[j].Name }
+func (p tagDiffEntries) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// TagDiff returns the list of tag differences between 2 releases/nightlies
+//
+// TagDiff is kept for compatibility: removed (resp. added) packages are
+// reported with a "None" package in the "new" (resp. "old") slot.
+// Use DiffReleases for a structured result.
+func TagDiff(old, new string, display, verbose bool) (map[string]map[string]Package, error) {
+	r, err := DiffReleases(old, new, TagDiffOptions{Verbose: verbose, Display: display})
+	if err != nil {
+		if display {
+			fmt.Printf("**error** %v\n", err)
+		}
+		return nil, err
+	}
+
+	// only report version differences, as TagDiff always did:
+	// project moves are left to TagDiffResult
+	entries := make([]TagDiffEntry, 0, len(r.Entries))
+	for _, e := range r.Entries {
+		if e.Old.Version == e.New.Version {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	r.Entries = entries
+
+	diffs := make(map[string]map[string]Package)
+	for _, e := range r.Entries {
+		p_old := e.Old
+		p_new := e.New
+		switch e.Kind {
+		case Added:
+			p_old = Package{"None", "None-00-00-00", p_new.Project}
+		case Removed:
+			p_new = Package{"None", "None-00-00-00", p_old.Project}
+		}
+		diffs[e.Name] = map[string]Package{
+			"old": p_old,
+			"new": p_new,
+		}
+	}
+
+	if len(diffs) == 0 {
+		return nil, nil
+	}
+
+	if !display {
+		return diffs, err
 	}
-	fmt.Printf(strings.Repeat("-", 120) + "\n")
-	fmt.Printf("::: found [%d] tags which are different\n", len(diffs))
 
+	err = TextRenderer{}.RenderTagDiff(os.Stdout, r)
 	return diffs, err
 }
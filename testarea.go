@@ -0,0 +1,189 @@
+package cmt
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// LocalPackage is a package checked out in a work area
+type LocalPackage struct {
+	Name     string // package full name (e.g. Control/AthenaKernel)
+	Dir      string // directory holding the package
+	Version  string // version of the package (tag, or trunk/branch name)
+	Source   string // where the version was read from: "version.cmt", "svn", "git" or ""
+	Modified bool   // whether the package has uncommitted changes
+}
+
+// TestArea returns the TestArea directory of the setup, or the working
+// directory of its subshell if $TestArea is not set
+func (s *Setup) TestArea() string {
+	if dir := s.Getenv("TestArea"); dir != "" {
+		return dir
+	}
+	return s.workdir()
+}
+
+// LocalPackages returns the packages checked out in the TestArea, sorted by name
+func (s *Setup) LocalPackages() ([]LocalPackage, error) {
+	area := s.TestArea()
+	names, err := scan_packages(area)
+	if err != nil {
+		return nil, err
+	}
+	pkgs := make([]LocalPackage, 0, len(names))
+	for _, name := range names {
+		pkg := LocalPackage{
+			Name: name,
+			Dir:  filepath.Join(area, filepath.FromSlash(name)),
+		}
+		s.inspect_package(&pkg)
+		pkgs = append(pkgs, pkg)
+	}
+	return pkgs, nil
+}
+
+// inspect_package fills the version and status of a local package, from
+// its cmt/version.cmt file or from its VCS metadata
+func (s *Setup) inspect_package(pkg *LocalPackage) {
+	vcs := ""
+	switch {
+	case path_exists(filepath.Join(pkg.Dir, ".svn")):
+		vcs = "svn"
+	case path_exists(filepath.Join(pkg.Dir, ".git")):
+		vcs = "git"
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(pkg.Dir, "cmt", "version.cmt"))
+	if err == nil {
+		pkg.Version = strings.TrimSpace(string(data))
+		pkg.Source = "version.cmt"
+	}
+
+	switch vcs {
+	case "svn":
+		if pkg.Version == "" {
+			pkg.Version = svn_version(s.output(pkg.Dir, "svn", "info"))
+			pkg.Source = vcs
+		}
+		pkg.Modified = len(bytes.TrimSpace(s.output(pkg.Dir, "svn", "status", "-q"))) > 0
+	case "git":
+		if pkg.Version == "" {
+			v := s.output(pkg.Dir, "git", "describe", "--tags", "--exact-match", "HEAD")
+			if len(v) == 0 {
+				v = s.output(pkg.Dir, "git", "rev-parse", "--abbrev-ref", "HEAD")
+			}
+			pkg.Version = string(bytes.TrimSpace(v))
+			pkg.Source = vcs
+		}
+		pkg.Modified = len(bytes.TrimSpace(s.output(pkg.Dir, "git", "status", "--porcelain", "--untracked-files=no"))) > 0
+	}
+}
+
+// output runs a program in `dir` with the environment of the setup and
+// returns its standard output (nil on failure)
+func (s *Setup) output(dir, name string, args ...string) []byte {
+	cmd := s.Command(context.Background(), name, args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	return out
+}
+
+// svn_version returns the version checked out in a SVN working copy,
+// from the output of 'svn info': the tag for .../tags/<tag>, the branch
+// name for .../branches/<branch> and "trunk" for .../trunk
+func svn_version(info []byte) string {
+	for _, line := range strings.Split(string(info), "\n") {
+		if !strings.HasPrefix(line, "URL: ") {
+			continue
+		}
+		url := strings.TrimSpace(line[len("URL: "):])
+		toks := strings.Split(url, "/")
+		for i, tok := range toks {
+			switch tok {
+			case "tags", "branches":
+				if i+1 < len(toks) {
+					return toks[i+1]
+				}
+			case "trunk":
+				return "trunk"
+			}
+		}
+	}
+	return ""
+}
+
+// DiffTestArea compares the packages checked out in the TestArea of the
+// setup with the corresponding packages of the release.
+// Old entries describe the release packages and New entries the local ones:
+// local packages are reported as Added (not in the release),
+// VersionChanged (Ahead or Behind the release) or Unchanged (identical),
+// with Modified set for packages with uncommitted changes.
+// Unchanged packages are only reported if opts.Unchanged is set, or if
+// they have uncommitted changes.
+// Release packages which are not checked out, and the WorkArea package,
+// are not reported.
+func (cmt *Cmt) DiffTestArea(opts TagDiffOptions) (*TagDiffResult, error) {
+	release := cmt.env.Getenv("AtlasVersion")
+	if release == "" {
+		release = "release"
+	}
+	m, err := cmt.Manifest(release)
+	if err != nil {
+		return nil, err
+	}
+	rel := m.Packages()
+
+	local, err := cmt.env.LocalPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TagDiffResult{
+		Old:         release,
+		New:         "TestArea",
+		OldProjects: m.ReleaseProjects(),
+		NewProjects: []ReleaseProject{{Name: "TestArea", Path: cmt.env.TestArea()}},
+		Entries:     make([]TagDiffEntry, 0, len(local)),
+	}
+
+	for _, lp := range local {
+		if pkg_basename(lp.Name) == WorkAreaPackageName {
+			continue
+		}
+		p_new := Package{Name: lp.Name, Version: lp.Version}
+		e := TagDiffEntry{Name: lp.Name, New: p_new, Modified: lp.Modified}
+		p_old, ok := rel[lp.Name]
+		switch {
+		case !ok:
+			e.Kind = Added
+		case p_old.Version == lp.Version:
+			e.Kind = Unchanged
+		default:
+			e.Kind = VersionChanged
+		}
+		if ok {
+			e.Old = p_old
+			e.New.Project = p_old.Project
+			if t, err := ParseTag(lp.Version); err == nil && t.BelongsTo(lp.Name) {
+				// trunk and branches can not be ordered w.r.t. tags
+				e.Order = compare_versions(lp.Version, p_old.Version)
+			}
+		}
+		if e.Kind == Unchanged && !e.Modified && !opts.Unchanged {
+			continue
+		}
+		if !opts.Filter.Match(e) {
+			continue
+		}
+		r.Entries = append(r.Entries, e)
+	}
+	return r, nil
+}
+
+// EOF
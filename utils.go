@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/gonuts/logger"
@@ -94,4 +95,52 @@ func extract_uses(fname string, msg *logger.Logger) ([]Package, error) {
 	return pkgs, err
 }
 
+// scan_packages returns the full names of the packages (directories holding
+// a cmt/requirements file) found under `topdir`, sorted.
+func scan_packages(topdir string) ([]string, error) {
+	pkgs := make([]string, 0)
+	err := filepath.Walk(topdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		name := fi.Name()
+		if path != topdir && (strings.HasPrefix(name, ".") || name == "InstallArea") {
+			return filepath.SkipDir
+		}
+		if !path_exists(filepath.Join(path, "cmt", "requirements")) {
+			return nil
+		}
+		pkg, err := filepath.Rel(topdir, path)
+		if err != nil {
+			return err
+		}
+		if pkg == "." {
+			// the top directory may be a package itself: look for
+			// packages below it
+			return nil
+		}
+		pkgs = append(pkgs, filepath.ToSlash(pkg))
+		// packages do not nest
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(pkgs)
+	return pkgs, nil
+}
+
+func sign(v int) int {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return +1
+	}
+	return 0
+}
+
 // EOF
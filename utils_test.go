@@ -0,0 +1,33 @@
+package cmt
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScanPackages(t *testing.T) {
+	top := t.TempDir()
+	for _, name := range []string{
+		"cmt/requirements", // the top directory is a package itself
+		"Control/AthenaKernel/cmt/requirements",
+		"Control/AthenaKernel/Nested/cmt/requirements",
+		"Tracking/TrkEvent/TrkTrack/cmt/requirements",
+		"InstallArea/Skipped/cmt/requirements",
+		".hidden/Skipped/cmt/requirements",
+		"NotAPackage/src/file.cxx",
+	} {
+		write_file(t, filepath.Join(top, filepath.FromSlash(name)), "")
+	}
+
+	pkgs, err := scan_packages(top)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Control/AthenaKernel", "Tracking/TrkEvent/TrkTrack"}
+	if !reflect.DeepEqual(pkgs, want) {
+		t.Fatalf("got %v, want %v", pkgs, want)
+	}
+}
+
+// EOF
@@ -0,0 +1,407 @@
+package cmt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// VCS is a version control system holding package sources
+type VCS interface {
+	// Type returns the type of the VCS ("svn" or "git")
+	Type() string
+
+	// Tags returns the tags of the package of the repository following
+	// the ATLAS convention, sorted from the oldest to the most recent one
+	Tags(r *Repository) ([]PackageTag, error)
+
+	// Branches returns the names of the branches of the package
+	Branches(r *Repository) ([]string, error)
+
+	// Checkout checks out the package into `dir`.
+	// `version` is a tag, a branch, or empty (or "trunk") for the trunk.
+	Checkout(r *Repository, version, dir string) error
+
+	// Status returns the status of the working copy `dir`
+	Status(dir string) ([]byte, error)
+
+	// Diff returns the uncommitted changes of the working copy `dir`
+	Diff(dir string) ([]byte, error)
+
+	// CreateTag creates the tag `tag` of the package from the working
+	// copy `dir` (svn: from the trunk if `dir` is empty)
+	CreateTag(r *Repository, dir, tag, msg string) error
+}
+
+// NewVCS returns the VCS of type `typ` ("svn" or "git"), running its
+// commands in the environment `env` (the current one if nil)
+func NewVCS(typ string, env *Setup) (VCS, error) {
+	switch typ {
+	case "svn", "":
+		return NewSVN(env), nil
+	case "git":
+		return NewGit(env), nil
+	}
+	return nil, fmt.Errorf("cmt: unknown VCS type [%s]", typ)
+}
+
+// RepoLayout describes where the trunk, tags and branches of a package live
+// in a repository. Paths are relative to the repository URL, and may use the
+// {pkg} (package full name) and {name} (package basename) placeholders.
+type RepoLayout struct {
+	Trunk    string `json:"trunk"`
+	Tags     string `json:"tags"`
+	Branches string `json:"branches"`
+}
+
+var (
+	// StandardLayout is the layout of the ATLAS offline repository
+	StandardLayout = RepoLayout{
+		Trunk:    "{pkg}/trunk",
+		Tags:     "{pkg}/tags",
+		Branches: "{pkg}/branches",
+	}
+
+	// GaudiLayout is the layout of the Gaudi repository
+	GaudiLayout = RepoLayout{
+		Trunk:    "Gaudi/trunk/{pkg}",
+		Tags:     "Gaudi/tags/{pkg}",
+		Branches: "Gaudi/branches/{pkg}",
+	}
+)
+
+// expand returns the path `tmpl` of the layout for the package `pkg`
+func (layout RepoLayout) expand(tmpl, pkg string) string {
+	return strings.NewReplacer("{pkg}", pkg, "{name}", pkg_basename(pkg)).Replace(tmpl)
+}
+
+// Repository locates the sources of a package
+type Repository struct {
+	Package     string     // package full name (e.g. Control/AthenaKernel)
+	URL         string     // URL of the repository
+	Layout      RepoLayout // layout of the package in the repository (unused for git)
+	VCS         VCS        // VCS of the repository
+	Credentials string     // hint on the credentials needed to access the repository
+}
+
+func (r *Repository) url(p string) string {
+	p = strings.Trim(r.Layout.expand(p, r.Package), "/")
+	if p == "" {
+		return r.URL
+	}
+	return strings.TrimRight(r.URL, "/") + "/" + p
+}
+
+// TrunkURL returns the URL of the trunk of the package
+func (r *Repository) TrunkURL() string {
+	return r.url(r.Layout.Trunk)
+}
+
+// TagsURL returns the URL of the directory holding the tags of the package
+func (r *Repository) TagsURL() string {
+	return r.url(r.Layout.Tags)
+}
+
+// BranchesURL returns the URL of the directory holding the branches of the package
+func (r *Repository) BranchesURL() string {
+	return r.url(r.Layout.Branches)
+}
+
+// Tags returns the tags of the package, sorted from the oldest to the most recent one
+func (r *Repository) Tags() ([]PackageTag, error) {
+	tags, err := r.VCS.Tags(r)
+	return tags, r.error(err)
+}
+
+// Branches returns the names of the branches of the package
+func (r *Repository) Branches() ([]string, error) {
+	branches, err := r.VCS.Branches(r)
+	return branches, r.error(err)
+}
+
+// Checkout checks out the version `version` of the package into `dir`
+func (r *Repository) Checkout(version, dir string) error {
+	return r.error(r.VCS.Checkout(r, version, dir))
+}
+
+// CreateTag creates the tag `tag` of the package from the working copy `dir`,
+// after checking it follows the ATLAS convention
+func (r *Repository) CreateTag(dir, tag, msg string) error {
+	t, err := ParseTag(tag)
+	if err != nil {
+		return err
+	}
+	err = t.Validate(r.Package)
+	if err != nil {
+		return err
+	}
+	return r.error(r.VCS.CreateTag(r, dir, tag, msg))
+}
+
+// error annotates a VCS error with the credentials hint of the repository
+func (r *Repository) error(err error) error {
+	if err == nil || r.Credentials == "" {
+		return err
+	}
+	return fmt.Errorf("%v\n(credentials for [%s]: %s)", err, r.URL, r.Credentials)
+}
+
+// RepoRule maps the packages matching a glob pattern to their repository
+type RepoRule struct {
+	Pattern     string     `json:"pattern"`               // glob pattern matched against the package full name and its parent directories
+	URL         string     `json:"url"`                   // URL of the repository ($VAR, ${VAR:-default}, {pkg} and {name} are expanded)
+	Type        string     `json:"type,omitempty"`        // VCS type ("svn" (default) or "git")
+	Layout      RepoLayout `json:"layout,omitempty"`      // layout of the packages in the repository (svn only, default: StandardLayout)
+	Credentials string     `json:"credentials,omitempty"` // hint on the credentials needed (e.g. "kinit user@CERN.CH")
+}
+
+// Match returns whether the rule applies to the package `pkg`
+func (rule *RepoRule) Match(pkg string) bool {
+	return match_globs([]string{rule.Pattern}, pkg)
+}
+
+// ResolveRepository returns the repository of `pkg` from the first
+// matching rule of `rules`, expanding the variables of the repository
+// URL from the environment `env` (the current one if nil)
+func ResolveRepository(rules []RepoRule, pkg string, env *Setup) (*Repository, error) {
+	getenv := os.Getenv
+	if env != nil {
+		getenv = env.Getenv
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.Match(pkg) {
+			continue
+		}
+		url := rule.Layout.expand(expand_vars(rule.URL, getenv), pkg)
+		if url == "" {
+			return nil, fmt.Errorf("cmt: empty repository URL [%s] for package [%s] (rule [%s])",
+				rule.URL, pkg, rule.Pattern,
+			)
+		}
+		vcs, err := NewVCS(rule.Type, env)
+		if err != nil {
+			return nil, err
+		}
+		layout := rule.Layout
+		if layout == (RepoLayout{}) && vcs.Type() == "svn" {
+			layout = StandardLayout
+		}
+		return &Repository{
+			Package:     pkg,
+			URL:         url,
+			Layout:      layout,
+			VCS:         vcs,
+			Credentials: rule.Credentials,
+		}, nil
+	}
+	return nil, fmt.Errorf("cmt: no repository rule for package [%s]", pkg)
+}
+
+// expand_vars replaces $VAR, ${VAR} and ${VAR:-default} in `s`
+func expand_vars(s string, getenv func(string) string) string {
+	return os.Expand(s, func(name string) string {
+		def := ""
+		if i := strings.Index(name, ":-"); i >= 0 {
+			name, def = name[:i], name[i+2:]
+		}
+		if v := getenv(name); v != "" {
+			return v
+		}
+		return def
+	})
+}
+
+// SVN is the Subversion VCS
+type SVN struct {
+	env *Setup
+}
+
+// NewSVN returns the Subversion VCS, running svn in the environment
+// `env` (the current one if nil)
+func NewSVN(env *Setup) *SVN {
+	return &SVN{env: env}
+}
+
+func (vcs *SVN) Type() string { return "svn" }
+
+func (vcs *SVN) Tags(r *Repository) ([]PackageTag, error) {
+	out, err := vcs_run(vcs.env, "", "svn", "ls", "--xml", r.TagsURL())
+	if err != nil {
+		return nil, err
+	}
+	tags, err := parse_svn_tags(out, r.Package)
+	if err != nil {
+		return nil, fmt.Errorf("cmt: could not parse tags of [%s]: %v", r.Package, err)
+	}
+	return tags, nil
+}
+
+func (vcs *SVN) Branches(r *Repository) ([]string, error) {
+	out, err := vcs_run(vcs.env, "", "svn", "ls", r.BranchesURL())
+	if err != nil {
+		return nil, err
+	}
+	branches := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.Trim(line, " /\r\t")
+		if line != "" {
+			branches = append(branches, line)
+		}
+	}
+	return branches, nil
+}
+
+func (vcs *SVN) Checkout(r *Repository, version, dir string) error {
+	url := r.TrunkURL()
+	switch checkout_kind(r.Package, version) {
+	case "tag":
+		url = r.TagsURL() + "/" + version
+	case "branch":
+		url = r.BranchesURL() + "/" + version
+	}
+	_, err := vcs_run(vcs.env, "", "svn", "checkout", "-q", url, dir)
+	return err
+}
+
+func (vcs *SVN) Status(dir string) ([]byte, error) {
+	return vcs_run(vcs.env, dir, "svn", "status")
+}
+
+func (vcs *SVN) Diff(dir string) ([]byte, error) {
+	return vcs_run(vcs.env, dir, "svn", "diff")
+}
+
+func (vcs *SVN) CreateTag(r *Repository, dir, tag, msg string) error {
+	src := dir
+	if src == "" {
+		src = r.TrunkURL()
+	}
+	_, err := vcs_run(vcs.env, "", "svn", "copy", "-m", msg, src, r.TagsURL()+"/"+tag)
+	return err
+}
+
+// Git is the git VCS. Each repository holds a single package, at its top
+// directory, whose tags follow the ATLAS convention (repository URLs
+// usually use the {name} placeholder).
+type Git struct {
+	env *Setup
+}
+
+// NewGit returns the git VCS, running git in the environment `env`
+// (the current one if nil)
+func NewGit(env *Setup) *Git {
+	return &Git{env: env}
+}
+
+func (vcs *Git) Type() string { return "git" }
+
+func (vcs *Git) Tags(r *Repository) ([]PackageTag, error) {
+	refs, err := vcs.refs(r, "--tags", "refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+	tags := make([]PackageTag, 0, len(refs))
+	for _, name := range refs {
+		t, err := ParseTag(name)
+		if err != nil || t.Validate(r.Package) != nil {
+			continue
+		}
+		tags = append(tags, PackageTag{Tag: t, Name: name})
+	}
+	sort_package_tags(tags)
+	return tags, nil
+}
+
+func (vcs *Git) Branches(r *Repository) ([]string, error) {
+	return vcs.refs(r, "--heads", "refs/heads/")
+}
+
+// refs returns the names of the remote references of the repository
+// selected by `flag`, without their `prefix`
+func (vcs *Git) refs(r *Repository, flag, prefix string) ([]string, error) {
+	out, err := vcs_run(vcs.env, "", "git", "ls-remote", "--refs", flag, r.URL)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], prefix) {
+			continue
+		}
+		names = append(names, strings.TrimPrefix(fields[1], prefix))
+	}
+	return names, nil
+}
+
+func (vcs *Git) Checkout(r *Repository, version, dir string) error {
+	args := []string{"clone", "-q"}
+	if checkout_kind(r.Package, version) != "trunk" {
+		args = append(args, "--branch", version)
+	}
+	args = append(args, r.URL, dir)
+	_, err := vcs_run(vcs.env, "", "git", args...)
+	return err
+}
+
+func (vcs *Git) Status(dir string) ([]byte, error) {
+	return vcs_run(vcs.env, dir, "git", "status", "--porcelain")
+}
+
+func (vcs *Git) Diff(dir string) ([]byte, error) {
+	return vcs_run(vcs.env, dir, "git", "diff", "HEAD")
+}
+
+func (vcs *Git) CreateTag(r *Repository, dir, tag, msg string) error {
+	if dir == "" {
+		return fmt.Errorf("cmt: git tags are created from a working copy")
+	}
+	_, err := vcs_run(vcs.env, dir, "git", "tag", "-a", "-m", msg, tag)
+	if err != nil {
+		return err
+	}
+	_, err = vcs_run(vcs.env, dir, "git", "push", "-q", r.URL, "refs/tags/"+tag)
+	return err
+}
+
+// checkout_kind returns whether `version` designates the "trunk", a "tag"
+// or a "branch" of the package `pkg`
+func checkout_kind(pkg, version string) string {
+	if version == "" || version == "trunk" || version == "HEAD" {
+		return "trunk"
+	}
+	t, err := ParseTag(version)
+	if err == nil && !t.Branch && t.BelongsTo(pkg) {
+		return "tag"
+	}
+	return "branch"
+}
+
+// vcs_run runs a VCS command in `dir` with the environment `env` (the
+// current one if nil) and returns its standard output
+func vcs_run(env *Setup, dir, name string, args ...string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if env != nil {
+		cmd = env.Command(context.Background(), name, args...)
+	} else {
+		cmd = exec.Command(name, args...)
+	}
+	if dir != "" {
+		cmd.Dir = dir
+	}
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("cmt: error running %s %s:\nerr: %v\n%s",
+			name, strings.Join(args, " "), err, stderr.String(),
+		)
+	}
+	return out, nil
+}
+
+// EOF
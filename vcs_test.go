@@ -0,0 +1,345 @@
+package cmt
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// run runs a command in `dir`, failing the test on errors
+func run(t *testing.T, dir, name string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("error running %s %s: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+}
+
+func write_file(t *testing.T, fname, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(fname, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read_file(t *testing.T, fname string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func tag_names(tags []PackageTag) []string {
+	names := make([]string, 0, len(tags))
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// newSVNRepo creates a local svn repository holding the package
+// Control/Foo, with a tag and a branch, and returns its URL
+func newSVNRepo(t *testing.T) string {
+	for _, name := range []string{"svn", "svnadmin"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not found", name)
+		}
+	}
+	tmp := t.TempDir()
+	repo := filepath.Join(tmp, "repo")
+	run(t, tmp, "svnadmin", "create", repo)
+	url := "file://" + filepath.ToSlash(repo)
+
+	src := filepath.Join(tmp, "import")
+	write_file(t, filepath.Join(src, "Control", "Foo", "trunk", "cmt", "requirements"), "package Foo\n")
+	write_file(t, filepath.Join(src, "Control", "Foo", "trunk", "src", "Foo.cxx"), "// tag\n")
+	run(t, tmp, "svn", "import", "-q", "-m", "import", src, url)
+	pkg := url + "/Control/Foo"
+	run(t, tmp, "svn", "mkdir", "-q", "-m", "layout", pkg+"/tags", pkg+"/branches")
+	run(t, tmp, "svn", "copy", "-q", "-m", "tag", pkg+"/trunk", pkg+"/tags/Foo-00-00-01")
+	run(t, tmp, "svn", "copy", "-q", "-m", "tag", pkg+"/trunk", pkg+"/tags/Foo-00-01-00")
+	run(t, tmp, "svn", "copy", "-q", "-m", "branch", pkg+"/tags/Foo-00-00-01", pkg+"/branches/Foo-00-00-01-branch")
+
+	wc := filepath.Join(tmp, "wc")
+	run(t, tmp, "svn", "checkout", "-q", pkg+"/trunk", wc)
+	write_file(t, filepath.Join(wc, "src", "Foo.cxx"), "// trunk\n")
+	run(t, wc, "svn", "commit", "-q", "-m", "trunk")
+	return url
+}
+
+// newGitRepo creates a local bare git repository holding the package
+// Control/Foo, with a tag and a branch, and returns its URL
+func newGitRepo(t *testing.T) string {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	for _, kv := range [][2]string{
+		{"GIT_AUTHOR_NAME", "cmt"}, {"GIT_AUTHOR_EMAIL", "cmt@example.com"},
+		{"GIT_COMMITTER_NAME", "cmt"}, {"GIT_COMMITTER_EMAIL", "cmt@example.com"},
+		{"GIT_CONFIG_NOSYSTEM", "1"}, {"HOME", t.TempDir()},
+	} {
+		t.Setenv(kv[0], kv[1])
+	}
+	tmp := t.TempDir()
+	repo := filepath.Join(tmp, "repo.git")
+	wc := filepath.Join(tmp, "wc")
+	run(t, tmp, "git", "init", "-q", "--bare", repo)
+	run(t, tmp, "git", "clone", "-q", repo, wc)
+	write_file(t, filepath.Join(wc, "cmt", "requirements"), "package Foo\n")
+	write_file(t, filepath.Join(wc, "src", "Foo.cxx"), "// tag\n")
+	run(t, wc, "git", "add", ".")
+	run(t, wc, "git", "commit", "-q", "-m", "import")
+	run(t, wc, "git", "tag", "Foo-00-00-01")
+	run(t, wc, "git", "tag", "Foo-00-01-00")
+	run(t, wc, "git", "tag", "Bar-01-00-00") // tag of another package
+	run(t, wc, "git", "checkout", "-q", "-b", "Foo-00-00-01-branch")
+	write_file(t, filepath.Join(wc, "src", "Foo.cxx"), "// branch\n")
+	run(t, wc, "git", "commit", "-q", "-a", "-m", "branch")
+	run(t, wc, "git", "checkout", "-q", "-")
+	write_file(t, filepath.Join(wc, "src", "Foo.cxx"), "// trunk\n")
+	run(t, wc, "git", "commit", "-q", "-a", "-m", "trunk")
+	run(t, wc, "git", "push", "-q", "origin", "--all")
+	run(t, wc, "git", "push", "-q", "origin", "--tags")
+	return repo
+}
+
+func testVCS(t *testing.T, typ, url string) {
+	rules := []RepoRule{{Pattern: "Control/*", URL: url, Type: typ}}
+	r, err := ResolveRepository(rules, "Control/Foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.VCS.Type() != typ {
+		t.Fatalf("got a %s repository, want %s", r.VCS.Type(), typ)
+	}
+
+	tags, err := r.Tags()
+	if err != nil {
+		t.Fatalf("tags: %v", err)
+	}
+	if got, want := tag_names(tags), []string{"Foo-00-00-01", "Foo-00-01-00"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("tags: got %v, want %v", got, want)
+	}
+
+	branches, err := r.Branches()
+	if err != nil {
+		t.Fatalf("branches: %v", err)
+	}
+	found := false
+	for _, b := range branches {
+		found = found || b == "Foo-00-00-01-branch"
+	}
+	if !found {
+		t.Fatalf("branches: got %v, want Foo-00-00-01-branch", branches)
+	}
+
+	tmp := t.TempDir()
+	for _, tc := range []struct {
+		version string
+		kind    string
+	}{
+		{"", "trunk"},
+		{"Foo-00-00-01", "tag"},
+		{"Foo-00-00-01-branch", "branch"},
+	} {
+		if got := checkout_kind(r.Package, tc.version); got != tc.kind {
+			t.Errorf("checkout kind of %q: got %s, want %s", tc.version, got, tc.kind)
+		}
+		dir := filepath.Join(tmp, tc.kind)
+		err = r.Checkout(tc.version, dir)
+		if err != nil {
+			t.Fatalf("checkout of %q: %v", tc.version, err)
+		}
+		if !path_exists(filepath.Join(dir, "cmt", "requirements")) {
+			t.Fatalf("checkout of %q: no cmt/requirements", tc.version)
+		}
+	}
+	if got := read_file(t, filepath.Join(tmp, "trunk", "src", "Foo.cxx")); got != "// trunk\n" {
+		t.Errorf("trunk checkout: got %q", got)
+	}
+	if got := read_file(t, filepath.Join(tmp, "branch", "src", "Foo.cxx")); got == "// trunk\n" {
+		t.Errorf("branch checkout: got the trunk")
+	}
+
+	wc := filepath.Join(tmp, "trunk")
+	out, err := r.VCS.Status(wc)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if len(strings.TrimSpace(string(out))) != 0 {
+		t.Fatalf("status of a fresh checkout: %q", out)
+	}
+	write_file(t, filepath.Join(wc, "src", "Foo.cxx"), "// modified\n")
+	out, err = r.VCS.Status(wc)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if !strings.Contains(string(out), "Foo.cxx") {
+		t.Fatalf("status of a modified checkout: %q", out)
+	}
+	out, err = r.VCS.Diff(wc)
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	if !strings.Contains(string(out), "+// modified") {
+		t.Fatalf("diff: %q", out)
+	}
+
+	err = r.CreateTag(wc, "Bar-00-01-01", "wrong package")
+	if err == nil {
+		t.Fatalf("created a tag of another package")
+	}
+	if typ == "git" {
+		run(t, wc, "git", "commit", "-q", "-a", "-m", "modified")
+	}
+	err = r.CreateTag(wc, "Foo-00-01-01", "new tag")
+	if err != nil {
+		t.Fatalf("create tag: %v", err)
+	}
+	tags, err = r.Tags()
+	if err != nil {
+		t.Fatalf("tags: %v", err)
+	}
+	if got := tags[len(tags)-1].Name; got != "Foo-00-01-01" {
+		t.Fatalf("latest tag: got %s, want Foo-00-01-01", got)
+	}
+	dir := filepath.Join(tmp, "new-tag")
+	err = r.Checkout("Foo-00-01-01", dir)
+	if err != nil {
+		t.Fatalf("checkout of the new tag: %v", err)
+	}
+	if got := read_file(t, filepath.Join(dir, "src", "Foo.cxx")); got != "// modified\n" {
+		t.Errorf("checkout of the new tag: got %q", got)
+	}
+}
+
+func TestSVN(t *testing.T) {
+	testVCS(t, "svn", newSVNRepo(t))
+}
+
+func TestGit(t *testing.T) {
+	testVCS(t, "git", newGitRepo(t))
+}
+
+func TestResolveRepository(t *testing.T) {
+	t.Setenv("SVNROOT", "svn+ssh://svn.cern.ch/reps/atlasoff")
+	t.Setenv("GAUDISVN", "")
+	t.Setenv("TDAQ_SVN", "svn+ssh://svn.cern.ch/reps/tdaq")
+
+	rules, err := ReadRepoRules(strings.NewReader(`{"rules": [
+	  {"pattern": "tdaq-common*", "url": "$TDAQ_SVN"},
+	  {"pattern": "LCG_*", "url": "https://gitlab.cern.ch/lcg/{name}.git", "type": "git", "credentials": "kinit"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules = append(rules, DefaultRepoRules...)
+
+	for _, tc := range []struct {
+		pkg   string
+		typ   string
+		url   string
+		trunk string
+		tags  string
+	}{
+		{
+			pkg:   "Control/AthenaKernel",
+			typ:   "svn",
+			url:   "svn+ssh://svn.cern.ch/reps/atlasoff",
+			trunk: "svn+ssh://svn.cern.ch/reps/atlasoff/Control/AthenaKernel/trunk",
+			tags:  "svn+ssh://svn.cern.ch/reps/atlasoff/Control/AthenaKernel/tags",
+		},
+		{
+			// Gaudi packages live in the Gaudi repository, under Gaudi/
+			pkg:   "GaudiKernel",
+			typ:   "svn",
+			url:   "http://svnweb.cern.ch/guest/gaudi",
+			trunk: "http://svnweb.cern.ch/guest/gaudi/Gaudi/trunk/GaudiKernel",
+			tags:  "http://svnweb.cern.ch/guest/gaudi/Gaudi/tags/GaudiKernel",
+		},
+		{
+			pkg:   "tdaq-common/eformat",
+			typ:   "svn",
+			url:   "svn+ssh://svn.cern.ch/reps/tdaq",
+			trunk: "svn+ssh://svn.cern.ch/reps/tdaq/tdaq-common/eformat/trunk",
+			tags:  "svn+ssh://svn.cern.ch/reps/tdaq/tdaq-common/eformat/tags",
+		},
+		{
+			pkg:   "LCG_Interfaces/ROOT",
+			typ:   "git",
+			url:   "https://gitlab.cern.ch/lcg/ROOT.git",
+			trunk: "https://gitlab.cern.ch/lcg/ROOT.git",
+			tags:  "https://gitlab.cern.ch/lcg/ROOT.git",
+		},
+	} {
+		r, err := ResolveRepository(rules, tc.pkg, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tc.pkg, err)
+			continue
+		}
+		if r.VCS.Type() != tc.typ {
+			t.Errorf("%s: got a %s repository, want %s", tc.pkg, r.VCS.Type(), tc.typ)
+		}
+		if r.URL != tc.url {
+			t.Errorf("%s: got URL %s, want %s", tc.pkg, r.URL, tc.url)
+		}
+		if got := r.TrunkURL(); got != tc.trunk {
+			t.Errorf("%s: got trunk %s, want %s", tc.pkg, got, tc.trunk)
+		}
+		if got := r.TagsURL(); got != tc.tags {
+			t.Errorf("%s: got tags %s, want %s", tc.pkg, got, tc.tags)
+		}
+	}
+
+	// an explicit $GAUDISVN overrides the default Gaudi repository
+	t.Setenv("GAUDISVN", "file:///data/gaudi")
+	r, err := ResolveRepository(rules, "GaudiPolicy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.TagsURL(), "file:///data/gaudi/Gaudi/tags/GaudiPolicy"; got != want {
+		t.Errorf("GaudiPolicy: got tags %s, want %s", got, want)
+	}
+
+	// errors mention the credentials hint of the repository
+	r, err = ResolveRepository(rules, "LCG_Interfaces/ROOT", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.error(os.ErrPermission); err == nil || !strings.Contains(err.Error(), "kinit") {
+		t.Errorf("got error %v, want the credentials hint", err)
+	}
+
+	t.Setenv("SVNROOT", "")
+	_, err = ResolveRepository(rules, "Control/AthenaKernel", nil)
+	if err == nil {
+		t.Errorf("resolved a repository with an empty $SVNROOT")
+	}
+
+	_, err = ReadRepoRules(strings.NewReader(`{"rules": [{"pattern": "X*", "url": "x", "type": "hg"}]}`))
+	if err == nil {
+		t.Errorf("read a rule with an unknown VCS")
+	}
+
+	// git repositories hold a single package
+	_, err = ReadRepoRules(strings.NewReader(`{"rules": [{"pattern": "X*", "url": "x", "type": "git",
+	  "layout": {"trunk": "{pkg}", "tags": "{pkg}", "branches": "{pkg}"}}]}`))
+	if err == nil {
+		t.Errorf("read a git rule with a layout")
+	}
+}
+
+// EOF
@@ -0,0 +1,222 @@
+package cmt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WorkAreaPackageName is the name of the package whose requirements use
+// all the packages of the work area, so 'cmt broadcast' builds them in order
+const WorkAreaPackageName = "WorkArea"
+
+const (
+	wa_begin_marker = "## --- begin of generated uses: do not edit ---"
+	wa_end_marker   = "## --- end of generated uses ---"
+)
+
+// RequirementsOptions configures the generation of the requirements of
+// the WorkArea package
+type RequirementsOptions struct {
+	Dir           string // directory of the WorkArea package (default: <work area>/WorkArea)
+	ExactVersions bool   // use the checked out tags instead of <pkg>-* patterns
+	DryRun        bool   // do not write the requirements file
+}
+
+// RequirementsUpdate describes an update of the requirements of the
+// WorkArea package
+type RequirementsUpdate struct {
+	File    string   // requirements file
+	Added   []string // packages added to the requirements
+	Stale   []string // entries removed because their package is not checked out anymore
+	Changed bool     // whether the content of the file changed
+}
+
+// UpdateRequirements generates, or updates, the requirements file of the
+// WorkArea package so it uses every package checked out in the work area.
+// Generated uses live between markers: the rest of an existing file is
+// preserved. Uses of a file without markers (e.g. made by setupWorkArea.py)
+// are taken over, except the ones of policy and external packages.
+func (wa *WorkArea) UpdateRequirements(opts RequirementsOptions) (*RequirementsUpdate, error) {
+	if opts.Dir == "" {
+		opts.Dir = filepath.Join(wa.Dir, WorkAreaPackageName)
+	}
+	fname := filepath.Join(opts.Dir, "cmt", "requirements")
+	upd := &RequirementsUpdate{File: fname}
+
+	old, err := ioutil.ReadFile(fname)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	head, prev, tail := split_wa_requirements(old)
+
+	uses := make(map[string]string)
+	for _, p := range wa.Packages {
+		if p.Dir == opts.Dir || pkg_basename(p.Name) == WorkAreaPackageName {
+			continue
+		}
+		line, err := wa.use_line(p, opts)
+		if err != nil {
+			return nil, err
+		}
+		uses[p.Name] = line
+	}
+
+	for name := range prev {
+		if _, ok := uses[name]; !ok {
+			upd.Stale = append(upd.Stale, name)
+		}
+	}
+	names := make([]string, 0, len(uses))
+	for name := range uses {
+		names = append(names, name)
+		if _, ok := prev[name]; !ok {
+			upd.Added = append(upd.Added, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(upd.Stale)
+	sort.Strings(upd.Added)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(head)
+	fmt.Fprintf(buf, "%s\n", wa_begin_marker)
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s\n", uses[name])
+	}
+	fmt.Fprintf(buf, "%s\n", wa_end_marker)
+	buf.WriteString(tail)
+
+	upd.Changed = !bytes.Equal(buf.Bytes(), old)
+	if !upd.Changed || opts.DryRun {
+		return upd, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(fname), 0755)
+	if err != nil {
+		return nil, err
+	}
+	tmp := fname + ".tmp"
+	err = ioutil.WriteFile(tmp, buf.Bytes(), 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, fname)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return upd, nil
+}
+
+// StaleRequirements returns the packages used by the requirements of the
+// WorkArea package which are not checked out anymore
+func (wa *WorkArea) StaleRequirements(opts RequirementsOptions) ([]string, error) {
+	opts.DryRun = true
+	upd, err := wa.UpdateRequirements(opts)
+	if err != nil {
+		return nil, err
+	}
+	return upd.Stale, nil
+}
+
+// use_line returns the 'use' statement of the package `p`, with its path
+// relative to the work area
+func (wa *WorkArea) use_line(p WorkAreaPackage, opts RequirementsOptions) (string, error) {
+	rel, err := filepath.Rel(wa.Dir, p.Dir)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("cmt: package [%s] is not under the work area [%s]", p.Name, wa.Dir)
+	}
+	name := pkg_basename(rel)
+	version := name + "-*"
+	if opts.ExactVersions && p.Kind == "tag" {
+		version = p.Version
+	}
+	line := "use " + name + " " + version
+	if dir := filepath.ToSlash(filepath.Dir(rel)); dir != "." {
+		line += " " + dir
+	}
+	return line, nil
+}
+
+// split_wa_requirements splits the requirements of a WorkArea package into
+// the text before and after the generated uses, and the generated uses,
+// indexed by package full name
+func split_wa_requirements(data []byte) (head string, uses map[string]bool, tail string) {
+	uses = make(map[string]bool)
+	if len(data) == 0 {
+		head = fmt.Sprintf("## automatically generated CMT requirements file\n"+
+			"package %s\n"+
+			"author  go-cmt\n\n"+
+			"## for athena policies: this has to be the first use statement\n"+
+			"use AtlasPolicy AtlasPolicy-*\n\n"+
+			"## for gaudi tools, services and objects\n"+
+			"use GaudiInterface GaudiInterface-* External\n\n",
+			WorkAreaPackageName,
+		)
+		return head, uses, ""
+	}
+
+	var hbuf, tbuf bytes.Buffer
+	marked := bytes.Contains(data, []byte(wa_begin_marker))
+	state := 0 // 0: head, 1: generated uses, 2: tail
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for scan.Scan() {
+		line := scan.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == wa_begin_marker:
+			state = 1
+			continue
+		case trimmed == wa_end_marker:
+			state = 2
+			continue
+		}
+		if state == 1 || (!marked && is_wa_use(trimmed)) {
+			if name := use_name(trimmed); name != "" {
+				uses[name] = true
+			}
+			continue
+		}
+		if state == 2 {
+			tbuf.WriteString(line + "\n")
+		} else {
+			hbuf.WriteString(line + "\n")
+		}
+	}
+	return hbuf.String(), uses, tbuf.String()
+}
+
+// is_wa_use returns whether `line` is the 'use' statement of a work area
+// package (i.e. not of a policy or external package)
+func is_wa_use(line string) bool {
+	name := use_name(line)
+	if name == "" {
+		return false
+	}
+	return !is_external(Package{Name: name})
+}
+
+// use_name returns the full name of the package used by a 'use' statement
+// ("" if `line` is not one)
+func use_name(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "use" {
+		return ""
+	}
+	if len(fields) >= 4 {
+		return fields[3] + "/" + fields[1]
+	}
+	return fields[1]
+}
+
+// EOF
@@ -0,0 +1,374 @@
+package cmt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Subscription is a webhook notified of the tag changes of a watched release
+type Subscription struct {
+	URL             string   `json:"url"`                        // URL the payload is POSTed to
+	Projects        []string `json:"projects,omitempty"`         // projects to report (empty: all)
+	ExcludeProjects []string `json:"exclude_projects,omitempty"` // projects not to report
+	Packages        []string `json:"packages,omitempty"`         // glob patterns of packages to report (empty: all)
+	NoExternals     bool     `json:"no_externals,omitempty"`     // do not report externals and policy packages
+}
+
+// filter returns the filter selecting the packages of the subscription
+func (sub *Subscription) filter() *TagDiffFilter {
+	return &TagDiffFilter{
+		Projects:        sub.Projects,
+		ExcludeProjects: sub.ExcludeProjects,
+		Packages:        sub.Packages,
+		NoExternals:     sub.NoExternals,
+	}
+}
+
+// WebhookPayload is the JSON document POSTed to subscriptions
+type WebhookPayload struct {
+	Old     string      `json:"old"`     // identifier of the reference release
+	New     string      `json:"new"`     // identifier of the watched release
+	Date    time.Time   `json:"date"`    // when the watched release was captured
+	Changes []jsonEntry `json:"changes"` // changed packages
+}
+
+// Watcher periodically computes the tag differences between the latest
+// state of a release (e.g. "latest,devval") and a reference (the previously
+// seen state, or a pinned manifest), and notifies subscriptions of the changes.
+//
+// The watcher remembers, in StateDir, the last release it saw and the
+// notifications it delivered, so nothing is reported twice.
+// Failed deliveries are retried, and kept for the next poll if they still fail.
+// Subscriptions already notified of a release which is not the reference
+// yet (because the delivery to other subscriptions failed) are then only
+// notified of the changes since that release.
+type Watcher struct {
+	Release       string         // release to watch (asetup tags or manifest file)
+	Reference     string         // pinned reference manifest file ("": previously seen release)
+	Subscriptions []Subscription // webhooks to notify
+	StateDir      string         // directory holding the state of the watcher
+	Interval      time.Duration  // time between polls (default: 1h)
+	Retries       int            // number of retries of failed deliveries
+	RetryDelay    time.Duration  // delay before the first retry, doubled at each retry (default: 1s)
+	Verbose       bool
+
+	Client *http.Client                         // HTTP client (default: http.DefaultClient)
+	Load   func(spec string) (*Manifest, error) // loads a release (default: LoadRelease)
+}
+
+// watcherState is the persistent state of a Watcher
+type watcherState struct {
+	Reported map[string]time.Time `json:"reported"` // delivered notifications
+}
+
+// maxReported is the maximum number of delivered notifications remembered
+const maxReported = 1000
+
+// prune forgets the notifications delivered before the reference release
+// was captured (they were about older releases), keeping at most
+// maxReported of the most recent ones
+func (state *watcherState) prune(ref time.Time) {
+	for key, t := range state.Reported {
+		if t.Before(ref) {
+			delete(state.Reported, key)
+		}
+	}
+	if len(state.Reported) <= maxReported {
+		return
+	}
+	keys := make([]string, 0, len(state.Reported))
+	for key := range state.Reported {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return state.Reported[keys[i]].After(state.Reported[keys[j]])
+	})
+	for _, key := range keys[maxReported:] {
+		delete(state.Reported, key)
+	}
+}
+
+// Run polls the watched release until `ctx` is done
+func (w *Watcher) Run(ctx context.Context) error {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	for {
+		err := w.Poll(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "**error** cmt.watcher: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Poll loads the watched release once, and notifies the subscriptions of
+// the changes w.r.t. the reference which were not reported yet.
+// Retries of failed deliveries are abandoned when `ctx` is done.
+func (w *Watcher) Poll(ctx context.Context) error {
+	err := os.MkdirAll(w.StateDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	cur, err := w.load(w.Release)
+	if err != nil {
+		return err
+	}
+
+	ref, err := w.reference()
+	if err != nil {
+		return err
+	}
+	if ref == nil {
+		// first poll: nothing to compare to yet
+		return cur.Save(w.last_fname())
+	}
+
+	state, err := w.state()
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, 0)
+	for _, sub := range w.Subscriptions {
+		old, err := w.delivered(sub.URL, ref)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		r := DiffManifests(old, cur, TagDiffOptions{})
+		changes := r.Filter(sub.filter()).Changes()
+		if len(changes) == 0 {
+			continue
+		}
+		key := notification_key(sub.URL, old, cur)
+		if _, ok := state.Reported[key]; ok {
+			continue
+		}
+		payload := WebhookPayload{
+			Old:     old.Release,
+			New:     cur.Release,
+			Date:    cur.Created,
+			Changes: make([]jsonEntry, 0, len(changes)),
+		}
+		for _, e := range changes {
+			payload.Changes = append(payload.Changes, jsonEntry{
+				Name: e.Name,
+				Kind: e.Kind.String(),
+				Old:  json_package(e.Old),
+				New:  json_package(e.New),
+			})
+		}
+		err = w.deliver(ctx, sub.URL, &payload)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		state.Reported[key] = time.Now().UTC()
+		if w.Reference == "" {
+			err = cur.Save(w.delivered_fname(sub.URL))
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	state.prune(ref.Created)
+	err = w.save_state(state)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 && w.Reference == "" {
+		// move the reference forward only once everything was delivered
+		err = cur.Save(w.last_fname())
+		if err != nil {
+			return err
+		}
+		for _, sub := range w.Subscriptions {
+			os.Remove(w.delivered_fname(sub.URL))
+		}
+	}
+	return combineErrors(errs...)
+}
+
+// delivered returns the release the subscription `url` was last notified
+// of, if more recent than the reference `ref` (`ref` otherwise)
+func (w *Watcher) delivered(url string, ref *Manifest) (*Manifest, error) {
+	if w.Reference != "" {
+		// changes are always reported w.r.t. the pinned reference
+		return ref, nil
+	}
+	fname := w.delivered_fname(url)
+	if !path_exists(fname) {
+		return ref, nil
+	}
+	m, err := LoadManifest(fname)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Created.After(ref.Created) {
+		return ref, nil
+	}
+	return m, nil
+}
+
+// deliver POSTs the payload to `url`, retrying on failures until `ctx`
+// is done
+func (w *Watcher) deliver(ctx context.Context, url string, payload *WebhookPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	delay := w.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	for i := 0; ; i++ {
+		err = post_json(ctx, client, url, data)
+		if err == nil {
+			if w.Verbose {
+				fmt.Printf("cmt.watcher: notified [%s] of %d changes\n", url, len(payload.Changes))
+			}
+			return nil
+		}
+		if i >= w.Retries {
+			return fmt.Errorf("cmt.watcher: could not notify [%s]: %v", url, err)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("cmt.watcher: could not notify [%s]: %v (%v)", url, err, ctx.Err())
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func post_json(ctx context.Context, client *http.Client, url string, data []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *Watcher) load(spec string) (*Manifest, error) {
+	if w.Load != nil {
+		return w.Load(spec)
+	}
+	return LoadRelease(spec, w.Verbose)
+}
+
+// reference returns the manifest the watched release is compared to
+// (nil if there is none yet)
+func (w *Watcher) reference() (*Manifest, error) {
+	if w.Reference != "" {
+		return LoadManifest(w.Reference)
+	}
+	fname := w.last_fname()
+	if !path_exists(fname) {
+		return nil, nil
+	}
+	return LoadManifest(fname)
+}
+
+func (w *Watcher) last_fname() string {
+	return filepath.Join(w.StateDir, "last.json")
+}
+
+// delivered_fname returns the file holding the release the subscription
+// `url` was last notified of
+func (w *Watcher) delivered_fname(url string) string {
+	h := sha1.Sum([]byte(url))
+	return filepath.Join(w.StateDir, "delivered-"+hex.EncodeToString(h[:8])+".json")
+}
+
+func (w *Watcher) state_fname() string {
+	return filepath.Join(w.StateDir, "state.json")
+}
+
+func (w *Watcher) state() (*watcherState, error) {
+	state := &watcherState{Reported: make(map[string]time.Time)}
+	data, err := ioutil.ReadFile(w.state_fname())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+	if state.Reported == nil {
+		state.Reported = make(map[string]time.Time)
+	}
+	return state, nil
+}
+
+func (w *Watcher) save_state(state *watcherState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := w.state_fname() + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, w.state_fname())
+}
+
+// notification_key identifies the notification of the changes between
+// `ref` and `cur` to `url`, by the content of the releases
+func notification_key(url string, ref, cur *Manifest) string {
+	h := sha1.New()
+	h.Write([]byte(url))
+	for _, m := range []*Manifest{ref, cur} {
+		h.Write([]byte{0})
+		pkgs := m.Packages()
+		names := make([]string, 0, len(pkgs))
+		for name := range pkgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(h, "%s %s %s\n", name, pkgs[name].Version, pkgs[name].Project)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// EOF
@@ -0,0 +1,355 @@
+package cmt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookServer is a local stand-in for the webhooks of subscriptions
+type hookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int                         // number of requests still to answer with a 503
+	requests int                         // number of requests received
+	payloads map[string][]WebhookPayload // delivered payloads, by path
+}
+
+func newHookServer(t *testing.T) *hookServer {
+	srv := &hookServer{payloads: make(map[string][]WebhookPayload)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		srv.requests++
+		if srv.failures > 0 {
+			srv.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			t.Errorf("invalid payload: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		srv.payloads[r.URL.Path] = append(srv.payloads[r.URL.Path], payload)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (srv *hookServer) delivered(path string) []WebhookPayload {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.payloads[path]
+}
+
+// testRelease is a release the watcher loads, whose package versions
+// tests modify between polls
+type testRelease struct {
+	pkgs map[string]Package
+}
+
+func (rel *testRelease) load(spec string) (*Manifest, error) {
+	m := &Manifest{Release: spec, Created: time.Now().UTC()}
+	projs := make(map[string]int)
+	for _, p := range rel.pkgs {
+		i, ok := projs[p.Project]
+		if !ok {
+			i = len(m.Projects)
+			projs[p.Project] = i
+			m.Projects = append(m.Projects, ManifestProject{
+				ReleaseProject: ReleaseProject{Name: p.Project},
+			})
+		}
+		m.Projects[i].Packages = append(m.Projects[i].Packages, p)
+	}
+	return m, nil
+}
+
+func (rel *testRelease) set(name, version string) {
+	p := rel.pkgs[name]
+	p.Version = version
+	rel.pkgs[name] = p
+}
+
+func newTestWatcher(t *testing.T, srv *hookServer, subs ...Subscription) (*Watcher, *testRelease) {
+	rel := &testRelease{pkgs: map[string]Package{
+		"Control/StoreGate":    {"Control/StoreGate", "StoreGate-02-00-00", "AtlasCore"},
+		"Control/AthenaKernel": {"Control/AthenaKernel", "AthenaKernel-01-00-00", "AtlasCore"},
+		"Tracking/TrkEvent":    {"Tracking/TrkEvent", "TrkEvent-00-10-00", "AtlasReconstruction"},
+	}}
+	for i := range subs {
+		subs[i].URL = srv.URL + subs[i].URL
+	}
+	w := &Watcher{
+		Release:       "latest,devval",
+		Subscriptions: subs,
+		StateDir:      t.TempDir(),
+		RetryDelay:    time.Millisecond,
+		Client:        srv.Client(),
+		Load:          rel.load,
+	}
+	return w, rel
+}
+
+func TestWatcherFilters(t *testing.T) {
+	ctx := context.Background()
+	srv := newHookServer(t)
+	w, rel := newTestWatcher(t, srv,
+		Subscription{URL: "/core", Projects: []string{"AtlasCore"}},
+		Subscription{URL: "/trk", Packages: []string{"Tracking/*"}},
+		Subscription{URL: "/all"},
+	)
+
+	err := w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+	if srv.requests != 0 {
+		t.Fatalf("first poll: got %d requests, want none", srv.requests)
+	}
+
+	rel.set("Control/StoreGate", "StoreGate-02-00-01")
+	rel.set("Tracking/TrkEvent", "TrkEvent-00-11-00")
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("second poll: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/core", []string{"Control/StoreGate"}},
+		{"/trk", []string{"Tracking/TrkEvent"}},
+		{"/all", []string{"Control/StoreGate", "Tracking/TrkEvent"}},
+	} {
+		payloads := srv.delivered(tc.path)
+		if len(payloads) != 1 {
+			t.Errorf("%s: got %d payloads, want 1", tc.path, len(payloads))
+			continue
+		}
+		changes := payloads[0].Changes
+		if len(changes) != len(tc.want) {
+			t.Errorf("%s: got %d changes, want %d (%+v)", tc.path, len(changes), len(tc.want), changes)
+			continue
+		}
+		for i, name := range tc.want {
+			if changes[i].Name != name || changes[i].Kind != "changed" {
+				t.Errorf("%s: change #%d: got %s (%s), want %s (changed)", tc.path, i, changes[i].Name, changes[i].Kind, name)
+			}
+		}
+	}
+}
+
+func TestWatcherRetries(t *testing.T) {
+	ctx := context.Background()
+	srv := newHookServer(t)
+	w, rel := newTestWatcher(t, srv, Subscription{URL: "/hook"})
+	w.Retries = 2
+
+	err := w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+
+	// transient failures are retried within the poll
+	srv.failures = 2
+	rel.set("Control/StoreGate", "StoreGate-02-00-01")
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("poll with transient failures: %v", err)
+	}
+	if got := len(srv.delivered("/hook")); got != 1 {
+		t.Fatalf("got %d payloads, want 1", got)
+	}
+	if srv.requests != 3 {
+		t.Fatalf("got %d requests, want 3", srv.requests)
+	}
+
+	// persistent failures are kept for the next poll
+	srv.failures = 3
+	rel.set("Control/StoreGate", "StoreGate-02-00-02")
+	err = w.Poll(ctx)
+	if err == nil {
+		t.Fatalf("expected a delivery error")
+	}
+	if got := len(srv.delivered("/hook")); got != 1 {
+		t.Fatalf("got %d payloads, want 1", got)
+	}
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("poll after failures: %v", err)
+	}
+	payloads := srv.delivered("/hook")
+	if len(payloads) != 2 {
+		t.Fatalf("got %d payloads, want 2", len(payloads))
+	}
+	if got := payloads[1].Changes[0].New.Version; got != "StoreGate-02-00-02" {
+		t.Fatalf("got version %s, want StoreGate-02-00-02", got)
+	}
+}
+
+func TestWatcherNoRedelivery(t *testing.T) {
+	ctx := context.Background()
+	srv := newHookServer(t)
+	w, rel := newTestWatcher(t, srv,
+		Subscription{URL: "/ok"},
+		Subscription{URL: "/flaky"},
+	)
+
+	err := w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+
+	// the first subscription is notified, the second one fails: the
+	// next poll only notifies the second one
+	rel.set("Control/AthenaKernel", "AthenaKernel-01-00-01")
+	srv.failures = 1
+	w.Subscriptions[0], w.Subscriptions[1] = w.Subscriptions[1], w.Subscriptions[0]
+	err = w.Poll(ctx)
+	if err == nil {
+		t.Fatalf("expected a delivery error")
+	}
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("second poll: %v", err)
+	}
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("third poll: %v", err)
+	}
+	for _, path := range []string{"/ok", "/flaky"} {
+		if got := len(srv.delivered(path)); got != 1 {
+			t.Errorf("%s: got %d payloads, want 1", path, got)
+		}
+	}
+
+	// the reference moved past the release /ok was notified of: its
+	// notification is forgotten
+	state, err := w.state()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Reported) != 1 {
+		t.Fatalf("got %d reported notifications, want 1", len(state.Reported))
+	}
+}
+
+func TestWatcherCatchUp(t *testing.T) {
+	ctx := context.Background()
+	srv := newHookServer(t)
+	w, rel := newTestWatcher(t, srv,
+		Subscription{URL: "/ok"},
+		Subscription{URL: "/flaky"},
+	)
+
+	err := w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+
+	// /ok is notified of the first change, /flaky is not
+	rel.set("Control/AthenaKernel", "AthenaKernel-01-00-01")
+	srv.failures = 1
+	w.Subscriptions[0], w.Subscriptions[1] = w.Subscriptions[1], w.Subscriptions[0]
+	err = w.Poll(ctx)
+	if err == nil {
+		t.Fatalf("expected a delivery error")
+	}
+
+	// the release changes again before the retry: /ok is only notified
+	// of the second change, /flaky of both
+	rel.set("Control/StoreGate", "StoreGate-02-00-01")
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("poll after the change: %v", err)
+	}
+	err = w.Poll(ctx)
+	if err != nil {
+		t.Fatalf("last poll: %v", err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want [][]string
+	}{
+		{"/ok", [][]string{{"Control/AthenaKernel"}, {"Control/StoreGate"}}},
+		{"/flaky", [][]string{{"Control/AthenaKernel", "Control/StoreGate"}}},
+	} {
+		payloads := srv.delivered(tc.path)
+		if len(payloads) != len(tc.want) {
+			t.Errorf("%s: got %d payloads, want %d", tc.path, len(payloads), len(tc.want))
+			continue
+		}
+		for i, want := range tc.want {
+			got := make([]string, 0)
+			for _, e := range payloads[i].Changes {
+				got = append(got, e.Name)
+			}
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("%s: payload #%d: got %v, want %v", tc.path, i, got, want)
+			}
+		}
+	}
+}
+
+func TestWatcherRetryCancel(t *testing.T) {
+	srv := newHookServer(t)
+	w, rel := newTestWatcher(t, srv, Subscription{URL: "/hook"})
+	w.Retries = 5
+	w.RetryDelay = time.Hour
+
+	err := w.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+
+	srv.failures = 10
+	rel.set("Control/StoreGate", "StoreGate-02-00-01")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = w.Poll(ctx)
+	if err == nil {
+		t.Fatalf("expected a delivery error")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Fatalf("retries not abandoned with the context (%v)", d)
+	}
+	if srv.requests != 1 {
+		t.Fatalf("got %d requests, want 1", srv.requests)
+	}
+}
+
+func TestWatcherStatePrune(t *testing.T) {
+	now := time.Now().UTC()
+	state := &watcherState{Reported: make(map[string]time.Time)}
+	state.Reported["old"] = now.Add(-time.Hour)
+	for i := 0; i < maxReported+10; i++ {
+		state.Reported[string(rune('a'+i%26))+time.Duration(i).String()] = now.Add(time.Duration(i) * time.Second)
+	}
+	state.prune(now)
+	if _, ok := state.Reported["old"]; ok {
+		t.Errorf("notification older than the reference was kept")
+	}
+	if len(state.Reported) != maxReported {
+		t.Errorf("got %d reported notifications, want %d", len(state.Reported), maxReported)
+	}
+	for _, ts := range state.Reported {
+		if ts.Before(now.Add(10 * time.Second)) {
+			t.Errorf("kept an old notification (%v)", ts.Sub(now))
+		}
+	}
+}
+
+// EOF
@@ -0,0 +1,249 @@
+package cmt
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// VCSStatus is the status of the files of a working copy
+type VCSStatus struct {
+	Modified    []string // modified (or conflicting, or renamed) files
+	Added       []string // files scheduled for addition
+	Deleted     []string // deleted (or missing) files
+	Unversioned []string // files not under version control
+}
+
+// Clean returns whether the working copy has no local changes
+// (unversioned files aside)
+func (st *VCSStatus) Clean() bool {
+	return len(st.Modified)+len(st.Added)+len(st.Deleted) == 0
+}
+
+// WorkAreaPackage is a package checked out in a work area
+type WorkAreaPackage struct {
+	LocalPackage
+	Kind    string    // what is checked out: "tag", "branch" or "trunk" ("" if unknown)
+	Status  VCSStatus // status of the files of the package
+	Release string    // version of the package in the release ("" if not in the release)
+	Order   int       // +1 (resp. -1) if the local tag is newer (resp. older) than the release one, 0 otherwise
+}
+
+// Shadows returns whether the package shadows the release with an older tag
+func (p *WorkAreaPackage) Shadows() bool {
+	return p.Kind == "tag" && p.Order < 0
+}
+
+// WorkArea is the inventory of the packages checked out in the TestArea
+// of a setup
+type WorkArea struct {
+	Dir      string            // directory of the work area
+	Packages []WorkAreaPackage // checked out packages, sorted by name
+
+	cmt *Cmt
+}
+
+// WorkArea scans the TestArea of the setup and returns its inventory
+func (cmt *Cmt) WorkArea() (*WorkArea, error) {
+	local, err := cmt.env.LocalPackages()
+	if err != nil {
+		return nil, err
+	}
+	wa := &WorkArea{
+		Dir:      cmt.env.TestArea(),
+		Packages: make([]WorkAreaPackage, 0, len(local)),
+		cmt:      cmt,
+	}
+	for _, lp := range local {
+		p := WorkAreaPackage{LocalPackage: lp}
+		p.Kind = local_checkout_kind(lp)
+		p.Status = cmt.vcs_status(lp)
+		p.Release = cmt.PackageVersion(pkg_basename(lp.Name))
+		if p.Kind == "tag" && p.Release != "" {
+			if t, err := ParseTag(p.Release); err == nil && t.BelongsTo(lp.Name) {
+				p.Order = compare_versions(lp.Version, p.Release)
+			}
+		}
+		wa.Packages = append(wa.Packages, p)
+	}
+	return wa, nil
+}
+
+// Package returns the checked out package `name` (full name or basename), or nil
+func (wa *WorkArea) Package(name string) *WorkAreaPackage {
+	for i := range wa.Packages {
+		p := &wa.Packages[i]
+		if p.Name == name || (!path_has_dir(name) && pkg_basename(p.Name) == name) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Modified returns the packages with local changes
+func (wa *WorkArea) Modified() []WorkAreaPackage {
+	out := make([]WorkAreaPackage, 0)
+	for _, p := range wa.Packages {
+		if !p.Status.Clean() {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Shadowing returns the packages shadowing the release with an older tag
+func (wa *WorkArea) Shadowing() []WorkAreaPackage {
+	out := make([]WorkAreaPackage, 0)
+	for _, p := range wa.Packages {
+		if p.Shadows() {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Write writes a human readable status report of the work area into `w`
+func (wa *WorkArea) Write(w io.Writer) error {
+	format := "%-30s %-6s | %-30s | %-8s | %s\n"
+	_, err := fmt.Fprintf(w, "::: work area [%s]\n", wa.Dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, format, "version", "kind", "release", "status", "pkg-name")
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 132))
+	for _, p := range wa.Packages {
+		fmt.Fprintf(w, format,
+			or_dash(p.Version), or_dash(p.Kind), or_dash(p.Release),
+			status_label(p), p.Name,
+		)
+	}
+	fmt.Fprintf(w, "%s\n", strings.Repeat("-", 132))
+	_, err = fmt.Fprintf(w, "::: %d packages, %d with local changes, %d shadowing the release with an older tag\n",
+		len(wa.Packages), len(wa.Modified()), len(wa.Shadowing()),
+	)
+	if err != nil {
+		return err
+	}
+	for _, p := range wa.Shadowing() {
+		fmt.Fprintf(w, "**warning** %s: %s is older than the release tag %s\n", p.Name, p.Version, p.Release)
+	}
+	return nil
+}
+
+// status_label summarizes the status of a package: M (modified),
+// A (added), D (deleted), ? (unversioned), < (older than the release),
+// > (newer than the release)
+func status_label(p WorkAreaPackage) string {
+	o := ""
+	for _, v := range []struct {
+		files []string
+		flag  string
+	}{
+		{p.Status.Modified, "M"},
+		{p.Status.Added, "A"},
+		{p.Status.Deleted, "D"},
+		{p.Status.Unversioned, "?"},
+	} {
+		if len(v.files) > 0 {
+			o += v.flag
+		}
+	}
+	switch {
+	case p.Order < 0:
+		o += "<"
+	case p.Order > 0:
+		o += ">"
+	}
+	return or_dash(o)
+}
+
+// local_checkout_kind returns whether a local package is a checkout of
+// a "tag", a "branch" or the "trunk" ("" if unknown)
+func local_checkout_kind(lp LocalPackage) string {
+	switch {
+	case lp.Version == "":
+		return ""
+	case same_checkout_version(lp, ""):
+		return "trunk"
+	}
+	return checkout_kind(lp.Name, lp.Version)
+}
+
+// vcs_status returns the status of the files of a local package
+func (cmt *Cmt) vcs_status(lp LocalPackage) VCSStatus {
+	var typ string
+	switch {
+	case path_exists(filepath.Join(lp.Dir, ".svn")):
+		typ = "svn"
+	case path_exists(filepath.Join(lp.Dir, ".git")):
+		typ = "git"
+	default:
+		return VCSStatus{}
+	}
+	vcs, err := NewVCS(typ, cmt.env)
+	if err != nil {
+		return VCSStatus{}
+	}
+	out, err := vcs.Status(lp.Dir)
+	if err != nil {
+		cmt.warnf("could not get the status of [%s]: %v\n", lp.Name, err)
+		return VCSStatus{}
+	}
+	if typ == "svn" {
+		return parse_svn_status(out)
+	}
+	return parse_git_status(out)
+}
+
+// parse_svn_status parses the output of 'svn status'
+func parse_svn_status(out []byte) VCSStatus {
+	var st VCSStatus
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) < 8 {
+			continue
+		}
+		fname := strings.TrimSpace(line[7:])
+		switch line[0] {
+		case 'M', 'C', 'R', '~':
+			st.Modified = append(st.Modified, fname)
+		case 'A':
+			st.Added = append(st.Added, fname)
+		case 'D', '!':
+			st.Deleted = append(st.Deleted, fname)
+		case '?':
+			st.Unversioned = append(st.Unversioned, fname)
+		default:
+			if line[1] == 'M' || line[1] == 'C' {
+				// property changes
+				st.Modified = append(st.Modified, fname)
+			}
+		}
+	}
+	return st
+}
+
+// parse_git_status parses the output of 'git status --porcelain'
+func parse_git_status(out []byte) VCSStatus {
+	var st VCSStatus
+	for _, line := range strings.Split(string(out), "\n") {
+		if len(line) < 4 {
+			continue
+		}
+		xy := line[:2]
+		fname := line[3:]
+		switch {
+		case xy == "??":
+			st.Unversioned = append(st.Unversioned, fname)
+		case strings.ContainsAny(xy, "D"):
+			st.Deleted = append(st.Deleted, fname)
+		case xy[0] == 'A':
+			st.Added = append(st.Added, fname)
+		case strings.ContainsAny(xy, "MRCUAT"):
+			st.Modified = append(st.Modified, fname)
+		}
+	}
+	return st
+}
+
+// EOF